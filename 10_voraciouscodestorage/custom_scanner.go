@@ -249,36 +249,40 @@ func ScanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	return 0, nil, nil
 }
 
-// ReadFull reads from buffer or the underlying connection until len(data) has been read
-func (s *Scanner) ReadFull(data []byte) (int, error) {
-	// if buffer already contains enough data, copy it and return
-	if s.end-s.start >= len(data) {
-		copy(data, s.buf[s.start:s.start+len(data)])
-		s.start += len(data)
-		return len(data), nil
-	}
-
-	//fmt.Printf("buffer didn't contain enough data (%d < %d)\n", s.end-s.start, len(data))
+// DataReader returns a reader for the next n bytes of input, drawn from the
+// buffer first and then from the underlying connection.
+func (s *Scanner) DataReader(n int) io.Reader {
+	return &dataReader{s: s, remaining: n}
+}
 
-	// if buffer contains some data, copy it and read the rest
-	originalLength := len(data)
-	n := s.end - s.start
-	copy(data, s.buf[s.start:s.end])
-	s.start = s.end
+type dataReader struct {
+	s         *Scanner
+	remaining int
+}
 
-	//fmt.Printf("buffer contributed %q\n", data[:n])
+func (d *dataReader) Read(p []byte) (int, error) {
+	if d.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if len(p) > d.remaining {
+		p = p[:d.remaining]
+	}
 
-	// when buffer is empty, read directly from the connection
-	if s.err != nil {
-		return 0, s.err
+	// drain the buffer before touching the connection
+	if d.s.end > d.s.start {
+		n := copy(p, d.s.buf[d.s.start:d.s.end])
+		d.s.start += n
+		d.remaining -= n
+		return n, nil
+	}
+	if d.s.err != nil {
+		return 0, d.s.err
 	}
 
-	// read the rest of the data
-	buf := make([]byte, originalLength-n)
-	m, err := io.ReadFull(s.r, buf)
-	if err != nil {
-		return 0, err
+	n, err := d.s.r.Read(p)
+	d.remaining -= n
+	if err == io.EOF && d.remaining > 0 {
+		err = io.ErrUnexpectedEOF
 	}
-	copy(data[n:], buf[:m])
-	return originalLength, nil
+	return n, err
 }
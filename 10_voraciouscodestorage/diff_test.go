@@ -0,0 +1,68 @@
+package voraciouscodestorage
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	t.Run("equal", func(t *testing.T) {
+		assert.Equal(t, "", unifiedDiff("/a r1", "/a r2", []byte("x\ny\n"), []byte("x\ny\n")))
+	})
+
+	t.Run("change in the middle", func(t *testing.T) {
+		a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n"
+		b := "1\n2\n3\n4\nfive\n6\n7\n8\n9\n"
+		assert.Equal(t, "--- /a r1\n+++ /a r2\n"+
+			"@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+			unifiedDiff("/a r1", "/a r2", []byte(a), []byte(b)))
+	})
+
+	t.Run("from empty", func(t *testing.T) {
+		assert.Equal(t, "--- /a r1\n+++ /a r2\n@@ -0,0 +1,2 @@\n+x\n+y\n",
+			unifiedDiff("/a r1", "/a r2", nil, []byte("x\ny\n")))
+	})
+
+	t.Run("no newline at end of file", func(t *testing.T) {
+		assert.Equal(t, "--- /a r1\n+++ /a r2\n@@ -1 +1 @@\n-x\n\\ No newline at end of file\n+x\n",
+			unifiedDiff("/a r1", "/a r2", []byte("x"), []byte("x\n")))
+	})
+
+	t.Run("separate hunks", func(t *testing.T) {
+		a := "a\n1\n2\n3\n4\n5\n6\n7\nb\n"
+		b := "A\n1\n2\n3\n4\n5\n6\n7\nB\n"
+		assert.Equal(t, "--- x\n+++ y\n"+
+			"@@ -1,4 +1,4 @@\n-a\n+A\n 1\n 2\n 3\n"+
+			"@@ -6,4 +6,4 @@\n 5\n 6\n 7\n-b\n+B\n",
+			unifiedDiff("x", "y", []byte(a), []byte(b)))
+	})
+}
+
+func TestDiffLinesReconstructs(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, rng.Intn(30))
+		for i := range lines {
+			lines[i] = string(rune('a'+rng.Intn(4))) + "\n"
+		}
+		return lines
+	}
+
+	for i := 0; i < 500; i++ {
+		a, b := randomLines(), randomLines()
+		var gotA, gotB []string
+		for _, op := range diffLines(a, b) {
+			if op.kind != '+' {
+				gotA = append(gotA, op.line)
+			}
+			if op.kind != '-' {
+				gotB = append(gotB, op.line)
+			}
+		}
+		assert.Equal(t, strings.Join(a, ""), strings.Join(gotA, ""))
+		assert.Equal(t, strings.Join(b, ""), strings.Join(gotB, ""))
+	}
+}
@@ -0,0 +1,118 @@
+package voraciouscodestorage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const exportAuthor = "voraciouscodestorage <vcs@localhost>"
+
+// change is a single PUT or DELETE, for replaying history in global order
+type change struct {
+	name     string
+	gitPath  string
+	seq      uint64
+	time     time.Time
+	revision int       // 0 for a deletion
+	r        *revision // nil for a deletion
+}
+
+// ExportGit writes the history of every file as a git fast-import stream on
+// the main branch, one commit per PUT or DELETE in the order they happened.
+// Import it with:
+//
+//	git init repo && git -C repo fast-import < stream
+func (s *Server) ExportGit(w io.Writer) error {
+	s.storageMutex.RLock()
+	changes := collectChanges(s.storage, "", "")
+	s.storageMutex.RUnlock()
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].seq < changes[j].seq })
+
+	bw := bufio.NewWriter(w)
+	for i, c := range changes {
+		fmt.Fprintf(bw, "commit refs/heads/main\n")
+		fmt.Fprintf(bw, "author %s %d +0000\n", exportAuthor, c.time.Unix())
+		fmt.Fprintf(bw, "committer %s %d +0000\n", exportAuthor, c.time.Unix())
+
+		var msg string
+		if c.r != nil {
+			msg = fmt.Sprintf("PUT %s r%d\n\nseq %d\n", c.name, c.revision, c.seq)
+		} else {
+			msg = fmt.Sprintf("DELETE %s\n\nseq %d\n", c.name, c.seq)
+		}
+		fmt.Fprintf(bw, "data %d\n%s", len(msg), msg)
+		if i == 0 {
+			// Start from an empty tree even if the branch already exists
+			fmt.Fprintf(bw, "deleteall\n")
+		}
+
+		if c.r == nil {
+			fmt.Fprintf(bw, "D %s\n\n", c.gitPath)
+			continue
+		}
+
+		fmt.Fprintf(bw, "M 100644 inline %s\n", c.gitPath)
+		fmt.Fprintf(bw, "data %d\n", c.r.size)
+		rc, err := s.openRevision(c.r)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(bw, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(bw, "\n\n")
+	}
+	return bw.Flush()
+}
+
+// ExportGitDataDir writes the history persisted in dataDir as a git
+// fast-import stream, without starting a server.
+func ExportGitDataDir(w io.Writer, dataDir string) error {
+	s := &Server{storage: newNode(), dataDir: dataDir}
+	if _, err := s.loadIndex(); err != nil {
+		return err
+	}
+	return s.ExportGit(w)
+}
+
+// collectChanges gathers every change below n. Paths that are both a file and
+// a directory can't be both in git, so such files are exported with a '~'
+// suffix, and segments starting with '.' get a '~' prefix so ".." and ".git"
+// stay legal. '~' never appears in a file name, so neither can collide.
+func collectChanges(n *node, name, gitPath string) []*change {
+	changes := []*change{}
+
+	filePath := gitPath
+	if len(n.children) > 0 || gitPath == "" {
+		filePath += "~"
+	}
+	if name == "" {
+		name = "/"
+	}
+	for i, r := range n.revisions {
+		changes = append(changes, &change{name: name, gitPath: filePath, seq: r.seq, time: r.time, revision: i + 1, r: r})
+	}
+	for _, t := range n.deletions {
+		changes = append(changes, &change{name: name, gitPath: filePath, seq: t.seq, time: t.time})
+	}
+
+	for segment, child := range n.children {
+		childName := strings.TrimSuffix(name, "/") + "/" + segment
+		if strings.HasPrefix(segment, ".") {
+			segment = "~" + segment
+		}
+		childPath := segment
+		if gitPath != "" {
+			childPath = gitPath + "/" + segment
+		}
+		changes = append(changes, collectChanges(child, childName, childPath)...)
+	}
+	return changes
+}
@@ -0,0 +1,279 @@
+package voraciouscodestorage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// indexFile is an append-only log of every stored revision, one JSON object
+// per line. It is replayed on startup to rebuild the directory tree.
+const indexFile = "index.log"
+
+// indexEntry records either a stored revision or, when Deleted is set, a
+// tombstone for Name.
+type indexEntry struct {
+	Name     string    `json:"name"`
+	Revision int       `json:"revision,omitempty"`
+	File     string    `json:"file,omitempty"`
+	Size     int       `json:"size"`
+	Time     time.Time `json:"time"`
+	Seq      uint64    `json:"seq"`
+	Deleted  bool      `json:"deleted,omitempty"`
+}
+
+// filesDir is the subdirectory of the data directory revisions are stored
+// in, so virtual names can't collide with the index
+const filesDir = "files"
+
+// diskName maps a revision of a virtual file to a path relative to the data
+// directory. The virtual hierarchy is mirrored under filesDir, with the
+// revision appended after an '@' (which is never legal in a file name).
+// Segments starting with '.' are prefixed with '@' so names like ".." cannot
+// escape the data directory or collide with temporary files.
+func diskName(name string, revision int) string {
+	parts := []string{filesDir}
+	for _, p := range splitPath(name) {
+		if strings.HasPrefix(p, ".") {
+			p = "@" + p
+		}
+		parts = append(parts, p)
+	}
+	return filepath.Join(parts...) + fmt.Sprintf("@%d", revision)
+}
+
+// openDataDir replays the index in s.dataDir into s.storage and opens the
+// index for appending.
+func (s *Server) openDataDir() error {
+	if err := os.MkdirAll(s.dataDir, 0o755); err != nil {
+		return err
+	}
+	if err := s.removeTempFiles(); err != nil {
+		return err
+	}
+
+	torn, err := s.loadIndex()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.dataDir, indexFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	// Terminate any torn line so the next entry starts cleanly
+	if torn {
+		if _, err := f.Write([]byte("\n")); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	s.index = f
+	return nil
+}
+
+// removeTempFiles deletes what a crash mid-PUT leaves behind: uploads spooled
+// in the data directory, and revisions half written under filesDir. Stored
+// names never start with '.', so nothing else is touched.
+func (s *Server) removeTempFiles() error {
+	entries, err := os.ReadDir(s.dataDir)
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".spool-") {
+			if err := os.Remove(filepath.Join(s.dataDir, e.Name())); err != nil {
+				return err
+			}
+			removed++
+		}
+	}
+
+	err = filepath.WalkDir(filepath.Join(s.dataDir, filesDir), func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasPrefix(d.Name(), ".tmp-") {
+			removed++
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if removed > 0 {
+		log.Printf("10_voraciouscodestorage at=data-dir.clean dir=%q removed=%d\n", s.dataDir, removed)
+	}
+	return err
+}
+
+// loadIndex replays the index in s.dataDir into s.storage. It reports whether
+// the index ends with a torn line.
+func (s *Server) loadIndex() (bool, error) {
+	contents, err := os.ReadFile(filepath.Join(s.dataDir, indexFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	count := 0
+	for _, line := range bytes.Split(contents, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var e indexEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			// A crash mid-append leaves a torn final line; skip it.
+			log.Printf("10_voraciouscodestorage at=index.load err=%q\n", err)
+			continue
+		}
+
+		// The index is written in global order, so entries from before
+		// sequence numbers were recorded can be numbered by position
+		if e.Seq == 0 {
+			e.Seq = s.seq + 1
+		}
+		if e.Seq > s.seq {
+			s.seq = e.Seq
+		}
+
+		if e.Deleted {
+			if n := s.storage.lookup(e.Name); n != nil && n.live {
+				n.deletions = append(n.deletions, &tombstone{seq: e.Seq, time: e.Time})
+				s.storage.setLive(e.Name, false)
+			}
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(s.dataDir, e.File)); err != nil {
+			log.Printf("10_voraciouscodestorage at=index.load name=%q revision=%d err=%q\n", e.Name, e.Revision, err)
+			continue
+		}
+		latest := 0
+		if n := s.storage.lookup(e.Name); n != nil {
+			latest = len(n.revisions)
+		}
+		if e.Revision != latest+1 {
+			log.Printf("10_voraciouscodestorage at=index.load name=%q revision=%d err=\"out of order\"\n", e.Name, e.Revision)
+			continue
+		}
+		n := s.storage.create(e.Name)
+		n.revisions = append(n.revisions, &revision{file: filepath.Join(s.dataDir, e.File), size: e.Size, time: e.Time, seq: e.Seq})
+		s.storage.setLive(e.Name, true)
+		count++
+	}
+
+	log.Printf("10_voraciouscodestorage at=index.loaded dir=%q revisions=%d\n", s.dataDir, count)
+	return len(contents) > 0 && contents[len(contents)-1] != '\n', nil
+}
+
+// storeRevision records the spooled data as the next revision of the file at
+// n, which also undeletes it. Callers must hold storageMutex for writing.
+func (s *Server) storeRevision(name string, n *node, sp *spool) (*revision, error) {
+	r := &revision{size: sp.size, time: time.Now().UTC(), seq: s.seq + 1}
+	rel := diskName(name, len(n.revisions)+1)
+	switch {
+	case s.dataDir != "":
+		r.file = filepath.Join(s.dataDir, rel)
+		if err := sp.commit(r.file); err != nil {
+			return nil, err
+		}
+		if err := s.appendIndex(indexEntry{Name: name, Revision: len(n.revisions) + 1, File: rel, Size: r.size, Time: r.time, Seq: r.seq}); err != nil {
+			return nil, err
+		}
+	case sp.onDisk():
+		// Large files stay on disk even when the server isn't persistent
+		r.file = filepath.Join(s.spoolDir, rel)
+		if err := sp.commit(r.file); err != nil {
+			return nil, err
+		}
+	default:
+		r.data = sp.bytes()
+	}
+
+	s.seq = r.seq
+	n.revisions = append(n.revisions, r)
+	s.storage.setLive(name, true)
+	return r, nil
+}
+
+// deleteFile tombstones the file at n. Its revisions stay readable. Callers
+// must hold storageMutex for writing.
+func (s *Server) deleteFile(name string, n *node) error {
+	t := &tombstone{seq: s.seq + 1, time: time.Now().UTC()}
+	if s.dataDir != "" {
+		if err := s.appendIndex(indexEntry{Name: name, Time: t.time, Seq: t.seq, Deleted: true}); err != nil {
+			return err
+		}
+	}
+
+	s.seq = t.seq
+	n.deletions = append(n.deletions, t)
+	s.storage.setLive(name, false)
+	return nil
+}
+
+func (s *Server) appendIndex(e indexEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := s.index.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
+
+// openRevision returns a reader over the contents of r
+func (s *Server) openRevision(r *revision) (io.ReadCloser, error) {
+	if r.file == "" {
+		return io.NopCloser(bytes.NewReader(r.data)), nil
+	}
+	return os.Open(r.file)
+}
+
+// readRevision returns the contents of r
+func (s *Server) readRevision(r *revision) ([]byte, error) {
+	rc, err := s.openRevision(r)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// writeFileAtomic writes data to a temporary file beside path and renames it
+// into place, so a crash never leaves a partially written revision.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -1,13 +1,14 @@
 package voraciouscodestorage
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"sort"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -21,17 +22,72 @@ type Server struct {
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
 
-	storage      map[string][][]byte
+	storage      *node
 	storageMutex sync.RWMutex
+	seq          uint64 // sequence number of the latest change to storage
+
+	dataDir string
+	index   *os.File
+
+	maxFileSize    int
+	spoolThreshold int
+	spoolDir       string
+}
+
+const (
+	defaultMaxFileSize    = 64 << 20
+	defaultSpoolThreshold = 1 << 20
+)
+
+type Option func(*Server)
+
+// WithDataDir persists every revision under dir and restores them on startup
+func WithDataDir(dir string) Option {
+	return func(s *Server) {
+		s.dataDir = dir
+	}
+}
+
+// WithMaxFileSize rejects PUTs longer than n bytes
+func WithMaxFileSize(n int) Option {
+	return func(s *Server) {
+		s.maxFileSize = n
+	}
 }
 
-func NewServer(ctx context.Context, port string) (*Server, error) {
+// WithSpoolThreshold keeps files larger than n bytes on disk rather than in
+// memory, both while they are uploaded and once stored
+func WithSpoolThreshold(n int) Option {
+	return func(s *Server) {
+		s.spoolThreshold = n
+	}
+}
+
+func NewServer(ctx context.Context, port string, opts ...Option) (*Server, error) {
+	s := &Server{storage: newNode(), maxFileSize: defaultMaxFileSize, spoolThreshold: defaultSpoolThreshold}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.dataDir != "" {
+		if err := s.openDataDir(); err != nil {
+			return nil, err
+		}
+		s.spoolDir = s.dataDir
+	} else {
+		dir, err := os.MkdirTemp("", "voraciouscodestorage-*")
+		if err != nil {
+			return nil, err
+		}
+		s.spoolDir = dir
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 
 	var lc net.ListenConfig
 	l, err := lc.Listen(ctx, "tcp", "0.0.0.0:"+port)
 	if err != nil {
 		cancel()
+		s.closeStorage()
 		return nil, err
 	}
 
@@ -39,7 +95,9 @@ func NewServer(ctx context.Context, port string) (*Server, error) {
 	l = &proxyproto.Listener{Listener: l}
 
 	log.Printf("10_voraciouscodestorage at=server.listening addr=%q\n", l.Addr().String())
-	s := &Server{Addr: l.Addr().String(), l: l, cancel: cancel, storage: map[string][][]byte{}}
+	s.Addr = l.Addr().String()
+	s.l = l
+	s.cancel = cancel
 
 	go s.acceptLoop(ctx)
 
@@ -55,7 +113,16 @@ func (s *Server) Close() error {
 
 	// Wait for all connections to gracefully close (allow systemd to sigkill us)
 	s.wg.Wait()
-	return nil
+
+	return s.closeStorage()
+}
+
+func (s *Server) closeStorage() error {
+	if s.dataDir == "" {
+		// Nothing spooled by a non-persistent server outlives it
+		return os.RemoveAll(s.spoolDir)
+	}
+	return s.index.Close()
 }
 
 func (s *Server) acceptLoop(ctx context.Context) {
@@ -105,7 +172,7 @@ func (s *Server) handleConn(conn net.Conn) {
 
 		switch strings.ToUpper(fields[0]) {
 		case "HELP":
-			replyf(conn, "OK usage: HELP|GET|PUT|LIST")
+			replyf(conn, "OK usage: HELP|GET|PUT|LIST|HISTORY|DIFF|DELETE")
 			replyf(conn, "READY")
 		case "LIST":
 			if len(fields) != 2 {
@@ -114,26 +181,28 @@ func (s *Server) handleConn(conn net.Conn) {
 			}
 
 			// if operand is not ascii, return error
-			if !isASCII(fields[1]) || fields[1][0] != '/' {
+			if !validPath(fields[1], true) {
 				replyf(conn, "ERR illegal dir name")
 				continue
 			}
 			s.storageMutex.RLock()
-			files := listDir(s.storage, fields[1])
+			files := []string{}
+			if dir := s.storage.lookup(fields[1]); dir != nil {
+				files = dir.list()
+			}
 			s.storageMutex.RUnlock()
 
-			sort.Strings(files)
 			replyf(conn, "OK %d", len(files))
 			for _, f := range files {
 				replyf(conn, "%s", f)
 			}
 			replyf(conn, "READY")
 		case "PUT":
-			if len(fields) != 3 {
+			if len(fields) != 3 && len(fields) != 4 {
 				replyf(conn, "ERR usage: PUT file length newline data")
 				continue
 			}
-			if !isASCII(fields[1]) || fields[1][0] != '/' {
+			if !validPath(fields[1], false) {
 				replyf(conn, "ERR illegal file name")
 				continue
 			}
@@ -147,45 +216,57 @@ func (s *Server) handleConn(conn net.Conn) {
 				continue
 			}
 
-			// Read file data
-			data := make([]byte, length)
-			log.Printf("--- Reading %d bytes\n", len(data))
-			n, err := scanner.ReadFull(data)
-			if err != nil || n != length {
-				fmt.Printf("Read %d bytes.  err=%s\n", n, err)
-				replyf(conn, "ERR reading file data")
-				continue
+			if length > s.maxFileSize {
+				// The upload can't be skipped without reading it, so give up on the client
+				replyf(conn, "ERR file too large")
+				return
+			}
+
+			// PUT file length if-rN only stores if rN is still the latest revision
+			ifRevision := -1
+			if len(fields) == 4 {
+				cond := strings.ToLower(fields[3])
+				r, err := strconv.Atoi(strings.TrimPrefix(cond, "if-r"))
+				if !strings.HasPrefix(cond, "if-r") || err != nil || r < 0 {
+					// Skip the upload so its data isn't taken for commands
+					if _, err := io.Copy(io.Discard, scanner.DataReader(length)); err != nil {
+						return
+					}
+					replyf(conn, "ERR illegal revision")
+					continue
+				}
+				ifRevision = r
 			}
-			log.Printf("--- Read %d bytes\n", len(data))
 
-			// check for content containing non-text character
-			if !isText(string(data)) {
-				fmt.Printf("Illegal file content: %q\n", string(data))
+			// Read file data, checking it is text as it arrives
+			log.Printf("--- Reading %d bytes\n", length)
+			sp := newSpool(s.spoolDir, s.spoolThreshold)
+			err = readText(sp, scanner.DataReader(length))
+			if errors.Is(err, errIllegalContent) {
+				sp.Close()
 				replyf(conn, "ERR illegal file content")
 				continue
 			}
-
-			// If latest revision matches, no need to store
-			s.storageMutex.RLock()
-			revisions, ok := s.storage[fields[1]]
-			s.storageMutex.RUnlock()
-
-			if ok && len(revisions) > 0 {
-				log.Printf("--- Comparing %d (incoming) with %d (latest)\n", len(data), len(revisions[len(revisions)-1]))
-				//log.Printf("--- %q\n", string(data))
-				//log.Printf("--- %q\n", string(revisions[len(revisions)-1]))
-				if string(revisions[len(revisions)-1]) == string(data) {
-					replyf(conn, "OK r%d", len(revisions))
-					replyf(conn, "READY")
-					continue
-				}
+			if err != nil {
+				sp.Close()
+				log.Printf("10_voraciouscodestorage at=put.read size=%d err=%q\n", sp.size, err)
+				replyf(conn, "ERR reading file data")
+				continue
 			}
+			log.Printf("--- Read %d bytes\n", sp.size)
 
-			// Store file data
-			s.storageMutex.Lock()
-			s.storage[fields[1]] = append(s.storage[fields[1]], data)
-			revision := len(s.storage[fields[1]])
-			s.storageMutex.Unlock()
+			revision, err := s.put(fields[1], sp, ifRevision)
+			sp.Close()
+			var conflict *conflictError
+			if errors.As(err, &conflict) {
+				replyf(conn, "ERR conflict: latest revision is r%d", conflict.latest)
+				continue
+			}
+			if err != nil {
+				log.Printf("10_voraciouscodestorage at=put.store err=%q\n", err)
+				replyf(conn, "ERR storing file data")
+				continue
+			}
 
 			replyf(conn, "OK r%d", revision)
 			replyf(conn, "READY")
@@ -197,50 +278,172 @@ func (s *Server) handleConn(conn net.Conn) {
 			}
 
 			// if operand is not ascii, return error
-			if !isASCII(fields[1]) || fields[1][0] != '/' {
+			if !validPath(fields[1], false) {
 				replyf(conn, "ERR illegal file name")
 				continue
 			}
 
-			var revision int
+			var rev int
 			if len(fields) == 3 {
-				r, err := strconv.Atoi(strings.TrimPrefix(fields[2], "r"))
+				r, err := parseRevision(fields[2])
 				if err != nil {
 					replyf(conn, "ERR illegal revision")
 					continue
 				}
-				if r <= 0 {
-					replyf(conn, "ERR illegal revision")
-					continue
-				}
-				revision = r
+				rev = r
 			}
 
 			// if file does not exist, return error
 
 			s.storageMutex.RLock()
-			revisions, ok := s.storage[fields[1]]
+			var revisions []*revision
+			live := false
+			if f := s.storage.lookup(fields[1]); f != nil {
+				revisions, live = f.revisions, f.live
+			}
 			s.storageMutex.RUnlock()
 
-			if !ok {
+			// deleted files are only readable by revision
+			if len(revisions) == 0 || (len(fields) == 2 && !live) {
 				replyf(conn, "ERR file does not exist")
 				continue
 			}
 
 			// if revision is specified, return that revision
 			if len(fields) == 3 {
-				if revision > len(revisions) {
+				if rev > len(revisions) {
 					replyf(conn, "ERR revision does not exist")
 					continue
 				}
 			} else {
 				// otherwise return latest revision
-				revision = len(revisions)
+				rev = len(revisions)
 			}
 
-			data := revisions[revision-1]
-			replyf(conn, "OK %d", len(data))
-			fmt.Fprintf(conn, "%s", data)
+			r := revisions[rev-1]
+			rc, err := s.openRevision(r)
+			if err != nil {
+				log.Printf("10_voraciouscodestorage at=get.read err=%q\n", err)
+				replyf(conn, "ERR reading file data")
+				continue
+			}
+			replyf(conn, "OK %d", r.size)
+			_, err = io.Copy(conn, rc)
+			rc.Close()
+			if err != nil {
+				// The client has already been promised r.size bytes
+				log.Printf("10_voraciouscodestorage at=get.write err=%q\n", err)
+				return
+			}
+			replyf(conn, "READY")
+
+		case "HISTORY":
+			if len(fields) != 2 {
+				replyf(conn, "ERR usage: HISTORY file")
+				continue
+			}
+			if !validPath(fields[1], false) {
+				replyf(conn, "ERR illegal file name")
+				continue
+			}
+
+			s.storageMutex.RLock()
+			var history []string
+			if f := s.storage.lookup(fields[1]); f != nil {
+				history = f.history()
+			}
+			s.storageMutex.RUnlock()
+
+			if len(history) == 0 {
+				replyf(conn, "ERR file does not exist")
+				continue
+			}
+			replyf(conn, "OK %d", len(history))
+			for _, h := range history {
+				replyf(conn, "%s", h)
+			}
+			replyf(conn, "READY")
+
+		case "DIFF":
+			if len(fields) != 4 {
+				replyf(conn, "ERR usage: DIFF file revision revision")
+				continue
+			}
+			if !validPath(fields[1], false) {
+				replyf(conn, "ERR illegal file name")
+				continue
+			}
+			revA, errA := parseRevision(fields[2])
+			revB, errB := parseRevision(fields[3])
+			if errA != nil || errB != nil {
+				replyf(conn, "ERR illegal revision")
+				continue
+			}
+
+			s.storageMutex.RLock()
+			revisions := s.storage.revisionsOf(fields[1])
+			s.storageMutex.RUnlock()
+
+			if len(revisions) == 0 {
+				replyf(conn, "ERR file does not exist")
+				continue
+			}
+			if revA > len(revisions) || revB > len(revisions) {
+				replyf(conn, "ERR revision does not exist")
+				continue
+			}
+
+			// Diffs are worked out in memory, so only of files small enough
+			// to have been kept there
+			if revisions[revA-1].size > s.spoolThreshold || revisions[revB-1].size > s.spoolThreshold {
+				replyf(conn, "ERR file too large to diff")
+				continue
+			}
+
+			a, errA := s.readRevision(revisions[revA-1])
+			b, errB := s.readRevision(revisions[revB-1])
+			if errA != nil || errB != nil {
+				log.Printf("10_voraciouscodestorage at=diff.read errA=%q errB=%q\n", errA, errB)
+				replyf(conn, "ERR reading file data")
+				continue
+			}
+			diff := unifiedDiff(fmt.Sprintf("%s r%d", fields[1], revA), fmt.Sprintf("%s r%d", fields[1], revB), a, b)
+			replyf(conn, "OK %d", len(diff))
+			if _, err := io.WriteString(conn, diff); err != nil {
+				log.Printf("10_voraciouscodestorage at=diff.write err=%q\n", err)
+				return
+			}
+			replyf(conn, "READY")
+
+		case "DELETE":
+			if len(fields) != 2 {
+				replyf(conn, "ERR usage: DELETE file")
+				continue
+			}
+			if !validPath(fields[1], false) {
+				replyf(conn, "ERR illegal file name")
+				continue
+			}
+
+			s.storageMutex.Lock()
+			f := s.storage.lookup(fields[1])
+			exists := f != nil && f.live
+			var err error
+			if exists {
+				err = s.deleteFile(fields[1], f)
+			}
+			s.storageMutex.Unlock()
+
+			if !exists {
+				replyf(conn, "ERR file does not exist")
+				continue
+			}
+			if err != nil {
+				log.Printf("10_voraciouscodestorage at=delete.store err=%q\n", err)
+				replyf(conn, "ERR storing file data")
+				continue
+			}
+			replyf(conn, "OK")
 			replyf(conn, "READY")
 
 		default:
@@ -253,6 +456,18 @@ func (s *Server) handleConn(conn net.Conn) {
 	}
 }
 
+// parseRevision parses a revision number, with or without its leading "r"
+func parseRevision(s string) (int, error) {
+	r, err := strconv.Atoi(strings.TrimPrefix(s, "r"))
+	if err != nil {
+		return 0, err
+	}
+	if r <= 0 {
+		return 0, fmt.Errorf("illegal revision %d", r)
+	}
+	return r, nil
+}
+
 func replyf(w io.Writer, format string, args ...interface{}) {
 	fmt.Fprintf(w, format+"\n", args...)
 	log.Printf("--> %s\n", fmt.Sprintf(format, args...))
@@ -269,30 +484,146 @@ func isASCII(s string) bool {
 	return true
 }
 
-func isText(s string) bool {
-	for _, r := range s {
-		if (r < 0x20 || r > 0x7e) && r != '\n' && r != '\r' && r != '\t' {
-			return false
+// conflictError is returned by put when a conditional PUT finds the file has
+// moved on from the expected revision
+type conflictError struct {
+	latest int
+}
+
+func (e *conflictError) Error() string {
+	return fmt.Sprintf("conflict: latest revision is r%d", e.latest)
+}
+
+// put stores sp as the next revision of name, unless it matches the latest
+// revision already. If ifRevision is not -1, the latest revision must be
+// ifRevision (0 meaning no live file). The contents are compared and written
+// out before taking the write lock, so a slow disk doesn't hold up everyone
+// else; the store then only happens if the file hasn't moved on meanwhile, so
+// concurrent PUTs can neither duplicate a revision nor lose an update.
+func (s *Server) put(name string, sp *spool, ifRevision int) (int, error) {
+	for {
+		s.storageMutex.RLock()
+		current, latest := s.latestRevision(name)
+		s.storageMutex.RUnlock()
+
+		if ifRevision >= 0 && ifRevision != current {
+			return 0, &conflictError{latest: current}
+		}
+
+		// If latest revision matches, no need to store
+		same := false
+		if latest != nil && latest.size == sp.size {
+			log.Printf("--- Comparing %d (incoming) with %d (latest)\n", sp.size, latest.size)
+			var err error
+			if same, err = s.sameContents(latest, sp); err != nil {
+				return 0, err
+			}
+		}
+		if !same && (s.dataDir != "" || sp.onDisk()) {
+			if err := sp.flush(); err != nil {
+				return 0, err
+			}
+		}
+
+		s.storageMutex.Lock()
+		if n, r := s.latestRevision(name); n != current || r != latest {
+			// Another PUT or DELETE got in first, so check again
+			s.storageMutex.Unlock()
+			continue
+		}
+		if same {
+			s.storageMutex.Unlock()
+			return current, nil
 		}
+		f := s.storage.create(name)
+		_, err := s.storeRevision(name, f, sp)
+		stored := len(f.revisions)
+		s.storageMutex.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		return stored, nil
 	}
-	return true
 }
 
-func listDir(storage map[string][][]byte, dir string) []string {
-	if dir[len(dir)-1] != '/' {
-		dir += "/"
+// latestRevision returns the number and contents of the latest revision of
+// the live file at name, or 0 and nil. Callers must hold storageMutex.
+func (s *Server) latestRevision(name string) (int, *revision) {
+	f := s.storage.lookup(name)
+	if f == nil || !f.live {
+		return 0, nil
 	}
-	files := []string{}
-	for f := range storage {
-		if strings.HasPrefix(f, dir) {
-			baseName := strings.TrimPrefix(f, dir)
-			if strings.Contains(baseName, "/") {
-				dirName := strings.Split(baseName, "/")[0] + "/"
-				files = append(files, dirName+" DIR")
-			} else {
-				files = append(files, baseName+" r1")
+	return len(f.revisions), f.revisions[len(f.revisions)-1]
+}
+
+var errIllegalContent = errors.New("illegal file content")
+
+// readText copies r to w, failing with errIllegalContent if it is not text.
+// Everything is read from r either way, so the connection stays in sync.
+func readText(w io.Writer, r io.Reader) error {
+	buf := make([]byte, 32*1024)
+	illegal := false
+	for {
+		n, err := r.Read(buf)
+		if n > 0 && !illegal {
+			if !isText(string(buf[:n])) {
+				illegal = true
+			} else if _, err := w.Write(buf[:n]); err != nil {
+				return err
 			}
 		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
 	}
-	return files
+	if illegal {
+		return errIllegalContent
+	}
+	return nil
+}
+
+// sameContents reports whether r holds exactly what was spooled
+func (s *Server) sameContents(r *revision, sp *spool) (bool, error) {
+	a, err := s.openRevision(r)
+	if err != nil {
+		return false, err
+	}
+	defer a.Close()
+	b, err := sp.open()
+	if err != nil {
+		return false, err
+	}
+	defer b.Close()
+
+	bufA, bufB := make([]byte, 32*1024), make([]byte, 32*1024)
+	for {
+		n, errA := io.ReadFull(a, bufA)
+		m, errB := io.ReadFull(b, bufB)
+		if !bytes.Equal(bufA[:n], bufB[:m]) {
+			return false, nil
+		}
+		endA := errA == io.EOF || errA == io.ErrUnexpectedEOF
+		endB := errB == io.EOF || errB == io.ErrUnexpectedEOF
+		if endA || endB {
+			return endA && endB, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+func isText(s string) bool {
+	for _, r := range s {
+		if (r < 0x20 || r > 0x7e) && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
 }
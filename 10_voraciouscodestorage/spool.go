@@ -0,0 +1,124 @@
+package voraciouscodestorage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// spool collects an incoming file in memory, moving it to a temporary file in
+// dir once it grows past threshold bytes.
+type spool struct {
+	dir       string
+	threshold int
+	buf       bytes.Buffer
+	file      *os.File
+	size      int
+	synced    bool // whether file is durable as it is
+}
+
+func newSpool(dir string, threshold int) *spool {
+	return &spool{dir: dir, threshold: threshold}
+}
+
+func (sp *spool) Write(p []byte) (int, error) {
+	if sp.file == nil && sp.buf.Len()+len(p) > sp.threshold {
+		if err := sp.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int
+	var err error
+	if sp.file != nil {
+		n, err = sp.file.Write(p)
+	} else {
+		n, err = sp.buf.Write(p)
+	}
+	sp.size += n
+	sp.synced = false
+	return n, err
+}
+
+// spill moves what has been spooled in memory to a temporary file
+func (sp *spool) spill() error {
+	f, err := os.CreateTemp(sp.dir, ".spool-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(sp.buf.Bytes()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	sp.file = f
+	sp.buf = bytes.Buffer{}
+	return nil
+}
+
+// flush durably writes everything spooled to a temporary file, so that
+// committing it is only a rename
+func (sp *spool) flush() error {
+	if sp.file == nil {
+		if err := sp.spill(); err != nil {
+			return err
+		}
+	}
+	if err := sp.file.Sync(); err != nil {
+		return err
+	}
+	sp.synced = true
+	return nil
+}
+
+// onDisk reports whether the spool has spilled to a temporary file
+func (sp *spool) onDisk() bool {
+	return sp.file != nil
+}
+
+// open returns a reader over everything written so far
+func (sp *spool) open() (io.ReadCloser, error) {
+	if sp.file != nil {
+		return os.Open(sp.file.Name())
+	}
+	return io.NopCloser(bytes.NewReader(sp.buf.Bytes())), nil
+}
+
+// bytes returns the spooled data when it is held in memory
+func (sp *spool) bytes() []byte {
+	return sp.buf.Bytes()
+}
+
+// commit durably moves the spooled data to path, replacing anything there
+func (sp *spool) commit(path string) error {
+	if sp.file == nil {
+		return writeFileAtomic(path, sp.buf.Bytes())
+	}
+
+	if !sp.synced {
+		if err := sp.file.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := sp.file.Close(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(sp.file.Name(), path); err != nil {
+		return err
+	}
+	sp.file = nil
+	return nil
+}
+
+// Close discards any uncommitted temporary file
+func (sp *spool) Close() error {
+	if sp.file == nil {
+		return nil
+	}
+	sp.file.Close()
+	return os.Remove(sp.file.Name())
+}
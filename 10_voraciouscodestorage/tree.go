@@ -0,0 +1,168 @@
+package voraciouscodestorage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// node is an entry in the virtual filesystem. A node can be a file (it has
+// revisions), a directory (it has children), or both at once. A deleted file
+// keeps its revisions but is no longer live.
+type node struct {
+	children  map[string]*node
+	revisions []*revision
+
+	deletions []*tombstone
+
+	live      bool
+	liveFiles int // live files in this subtree, including this node
+}
+
+// revision is one stored version of a file. Its contents are held in memory,
+// or on disk in file when the server is persistent or the file is large.
+type revision struct {
+	data []byte
+	file string
+	size int
+	time time.Time
+	seq  uint64 // position among all changes to the server
+}
+
+// tombstone records a file being deleted
+type tombstone struct {
+	time time.Time
+	seq  uint64
+}
+
+func newNode() *node {
+	return &node{children: map[string]*node{}}
+}
+
+// validPath reports whether path is absolute, made of legal characters, and
+// has no empty segments, so no two paths name the same node. Directories,
+// unlike files, may end in a slash.
+func validPath(path string, dir bool) bool {
+	if !isASCII(path) || !strings.HasPrefix(path, "/") {
+		return false
+	}
+	if dir {
+		if path == "/" {
+			return true
+		}
+		path = strings.TrimSuffix(path, "/")
+	}
+	for _, p := range strings.Split(path[1:], "/") {
+		if p == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func splitPath(path string) []string {
+	parts := []string{}
+	for _, p := range strings.Split(path, "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// lookup returns the node at path, or nil if it does not exist
+func (n *node) lookup(path string) *node {
+	for _, p := range splitPath(path) {
+		n = n.children[p]
+		if n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// setLive marks the file at path as live or deleted, keeping the live file
+// counts of it and its parents in sync. The node must already exist.
+func (n *node) setLive(path string, live bool) {
+	f := n.lookup(path)
+	if f == nil || f.live == live {
+		return
+	}
+	f.live = live
+
+	delta := 1
+	if !live {
+		delta = -1
+	}
+	n.liveFiles += delta
+	for _, p := range splitPath(path) {
+		n = n.children[p]
+		n.liveFiles += delta
+	}
+}
+
+// revisionsOf returns the revisions of the file at path, if any
+func (n *node) revisionsOf(path string) []*revision {
+	if f := n.lookup(path); f != nil {
+		return f.revisions
+	}
+	return nil
+}
+
+// create returns the node at path, creating it and any parents as needed
+func (n *node) create(path string) *node {
+	for _, p := range splitPath(path) {
+		child, ok := n.children[p]
+		if !ok {
+			child = newNode()
+			n.children[p] = child
+		}
+		n = child
+	}
+	return n
+}
+
+// list returns the entries of a directory node, sorted by name. Files are
+// listed with their latest revision; a name that is both a file and a
+// directory is listed as each. Deleted files and directories holding only
+// deleted files are left out.
+func (n *node) list() []string {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]string, 0, len(names))
+	for _, name := range names {
+		child := n.children[name]
+		dirFiles := child.liveFiles
+		if child.live {
+			entries = append(entries, fmt.Sprintf("%s r%d", name, len(child.revisions)))
+			dirFiles--
+		}
+		if dirFiles > 0 {
+			entries = append(entries, name+"/ DIR")
+		}
+	}
+	return entries
+}
+
+// history describes each revision and deletion of a file node, in the order
+// they happened
+func (n *node) history() []string {
+	history := make([]string, 0, len(n.revisions)+len(n.deletions))
+	i, j := 0, 0
+	for i < len(n.revisions) || j < len(n.deletions) {
+		if j == len(n.deletions) || i < len(n.revisions) && n.revisions[i].seq < n.deletions[j].seq {
+			r := n.revisions[i]
+			history = append(history, fmt.Sprintf("r%d %d %s", i+1, r.size, r.time.Format(time.RFC3339)))
+			i++
+		} else {
+			history = append(history, fmt.Sprintf("DELETED %s", n.deletions[j].time.Format(time.RFC3339)))
+			j++
+		}
+	}
+	return history
+}
@@ -0,0 +1,60 @@
+package budgetchat
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RoomConfig controls what a room remembers
+type RoomConfig struct {
+	// HistorySize is how many chat messages are replayed to new joiners
+	HistorySize int
+
+	// TranscriptDir, if set, is where each room appends a timestamped
+	// transcript of everything said and announced in it
+	TranscriptDir string
+}
+
+// history is a ring buffer of the most recent messages
+type history struct {
+	msgs []string
+	next int
+	full bool
+}
+
+func newHistory(size int) *history {
+	return &history{msgs: make([]string, size)}
+}
+
+func (h *history) add(msg string) {
+	if len(h.msgs) == 0 {
+		return
+	}
+	h.msgs[h.next] = msg
+	h.next = (h.next + 1) % len(h.msgs)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// all returns the remembered messages, oldest first
+func (h *history) all() []string {
+	if !h.full {
+		return append([]string(nil), h.msgs[:h.next]...)
+	}
+	return append(append([]string(nil), h.msgs[h.next:]...), h.msgs[:h.next]...)
+}
+
+// openTranscript opens the transcript for the named room for appending
+func openTranscript(dir, room string) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(filepath.Join(dir, room+".log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+}
+
+func transcriptLine(msg string) string {
+	return fmt.Sprintf("%s %s\n", time.Now().UTC().Format(time.RFC3339), msg)
+}
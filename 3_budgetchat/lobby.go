@@ -0,0 +1,127 @@
+package budgetchat
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultRoom is where sessions go once they've chosen a name
+const DefaultRoom = "lobby"
+
+// Lobby holds the named rooms. Rooms are created when first joined and
+// removed once the last session leaves.
+type Lobby struct {
+	sync.Mutex
+	rooms    map[string]*Room
+	sessions map[string]*Session // by name, which is unique across rooms
+	config   RoomConfig
+
+	// Policy applies to every session in the lobby
+	Policy Policy
+}
+
+func NewLobby(cfg RoomConfig) *Lobby {
+	return &Lobby{rooms: map[string]*Room{}, sessions: map[string]*Session{}, config: cfg}
+}
+
+// Register claims name for s, reporting false if another session has it
+func (l *Lobby) Register(s *Session, name string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := l.sessions[name]; ok {
+		return false
+	}
+	l.sessions[name] = s
+	s.Name = name
+	return true
+}
+
+// Unregister frees the name of s
+func (l *Lobby) Unregister(s *Session) {
+	l.Lock()
+	defer l.Unlock()
+	if l.sessions[s.Name] == s {
+		delete(l.sessions, s.Name)
+	}
+}
+
+// Rename moves s to a new name, reporting false if another session has it.
+// Everyone in the room of s is told about the change.
+func (l *Lobby) Rename(s *Session, name string) bool {
+	l.Lock()
+	if _, ok := l.sessions[name]; ok {
+		l.Unlock()
+		return false
+	}
+	delete(l.sessions, s.Name)
+	l.sessions[name] = s
+	l.Unlock()
+
+	if s.Room != nil {
+		s.Room.Rename(s, name)
+	} else {
+		s.Name = name
+	}
+	return true
+}
+
+// Find returns the session with the given name, or nil
+func (l *Lobby) Find(name string) *Session {
+	l.Lock()
+	defer l.Unlock()
+	return l.sessions[name]
+}
+
+// Join adds s to the named room, creating it if needed
+func (l *Lobby) Join(s *Session, name string) {
+	l.Lock()
+	r, ok := l.rooms[name]
+	if !ok {
+		r = NewRoom(name, l.config)
+		l.rooms[name] = r
+		log.Printf("3_budgetchat at=lobby.create room=%s\n", name)
+	}
+	// Hold a reference so the room isn't collected before the join lands
+	r.refs++
+	l.Unlock()
+
+	r.Join(s)
+}
+
+// Leave removes s from its room, removing the room if it is now empty
+func (l *Lobby) Leave(s *Session) {
+	r := s.Room
+	if r == nil {
+		return
+	}
+	r.Leave(s)
+	s.Room = nil
+
+	l.Lock()
+	r.refs--
+	if r.refs == 0 {
+		delete(l.rooms, r.Name)
+		r.Close()
+		log.Printf("3_budgetchat at=lobby.remove room=%s\n", r.Name)
+	}
+	l.Unlock()
+}
+
+// Describe lists every room and how many sessions are in it
+func (l *Lobby) Describe() string {
+	l.Lock()
+	rooms := []string{}
+	for name, r := range l.rooms {
+		rooms = append(rooms, fmt.Sprintf("%s (%d)", name, r.Len()))
+	}
+	l.Unlock()
+
+	if len(rooms) == 0 {
+		return "* There are no rooms"
+	}
+	sort.Strings(rooms)
+	return fmt.Sprintf("* Rooms: %s", strings.Join(rooms, ", "))
+}
@@ -0,0 +1,106 @@
+package budgetchat
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Policy limits what sessions may send
+type Policy struct {
+	// MaxMessageLength is the longest line a client may send, zero meaning
+	// bufio's default
+	MaxMessageLength int
+
+	// RateLimit is how many lines per second a client may sustain after
+	// spending Burst, zero meaning unlimited
+	RateLimit float64
+	Burst     int
+
+	// Moderator, if set, vets every chat message before it is broadcast
+	Moderator Moderator
+
+	// OperatorPassword, if set, lets a session /oper to gain /kick
+	OperatorPassword string
+}
+
+// Verdict is what a Moderator decides to do with a message
+type Verdict int
+
+const (
+	// Allow delivers the message
+	Allow Verdict = iota
+	// Flag delivers the message but logs it for the operators
+	Flag
+	// Drop discards the message
+	Drop
+)
+
+// Moderator vets chat messages. It may rewrite msg by returning a different
+// string alongside Allow or Flag.
+type Moderator interface {
+	Moderate(room, from, msg string) (string, Verdict)
+}
+
+// WordFilter is a Moderator that masks banned words, or drops messages
+// containing them if DropMessages is set
+type WordFilter struct {
+	DropMessages bool
+	re           *regexp.Regexp
+}
+
+// NewWordFilter bans the given words, matched whole and case-insensitively
+func NewWordFilter(words ...string) *WordFilter {
+	quoted := make([]string, 0, len(words))
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			quoted = append(quoted, regexp.QuoteMeta(w))
+		}
+	}
+	f := &WordFilter{}
+	if len(quoted) > 0 {
+		f.re = regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+	}
+	return f
+}
+
+func (f *WordFilter) Moderate(room, from, msg string) (string, Verdict) {
+	if f.re == nil || !f.re.MatchString(msg) {
+		return msg, Allow
+	}
+	if f.DropMessages {
+		return msg, Drop
+	}
+	return f.re.ReplaceAllStringFunc(msg, func(w string) string {
+		return strings.Repeat("*", len(w))
+	}), Flag
+}
+
+// tokenBucket allows bursts of up to burst events, refilling at rate per
+// second
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -3,36 +3,106 @@ package budgetchat
 import (
 	"fmt"
 	"log"
+	"os"
 	"strings"
 	"sync"
 )
 
 type Room struct {
 	sync.Mutex
-	sessions []Session
+	Name     string
+	sessions []*Session
+
+	history    *history
+	transcript *os.File
+
+	refs int // sessions joined or joining, guarded by the Lobby
+}
+
+func NewRoom(name string, cfg RoomConfig) *Room {
+	r := &Room{Name: name, history: newHistory(cfg.HistorySize)}
+	if cfg.TranscriptDir != "" {
+		f, err := openTranscript(cfg.TranscriptDir, name)
+		if err != nil {
+			// Chat carries on without a transcript
+			log.Printf("3_budgetchat at=room.transcript room=%s err=%q\n", name, err.Error())
+		} else {
+			r.transcript = f
+		}
+	}
+	return r
 }
 
-func NewRoom() *Room {
-	return &Room{}
+// Close releases the transcript once the room is no longer in use
+func (r *Room) Close() error {
+	if r.transcript != nil {
+		return r.transcript.Close()
+	}
+	return nil
 }
 
 func (r *Room) Join(s *Session) {
+	r.Lock()
+	var intro []string
 	if len(r.sessions) > 0 {
-		s.SendMessage(fmt.Sprintf("* The room contains: %s", names(r.sessions)))
+		intro = append(intro, fmt.Sprintf("* The room contains: %s", names(r.sessions)))
 	} else {
-		s.SendMessage("* The room is empty")
+		intro = append(intro, "* The room is empty")
 	}
-
-	r.Lock()
-	r.sessions = append(r.sessions, *s)
+	if msgs := r.history.all(); len(msgs) > 0 {
+		intro = append(intro, fmt.Sprintf("* Replaying the last %d messages:", len(msgs)))
+		intro = append(intro, msgs...)
+		intro = append(intro, "* End of replay")
+	}
+	// Queued as one, so however much history there is it can't overflow
+	// the joiner's queue
+	s.SendMessage(strings.Join(intro, "\n"))
+	r.sessions = append(r.sessions, s)
 	s.Room = r
 	r.Unlock()
 
 	r.Broadcast(s, fmt.Sprintf("* %s has entered the room", s.Name))
-	log.Printf("3_budgetchat at=room.join name=%s\n", s.Name)
+	log.Printf("3_budgetchat at=room.join room=%s name=%s\n", r.Name, s.Name)
+}
+
+// Post sends a chat message from s to everyone else in the room, remembering
+// it for replay to later joiners
+func (r *Room) Post(s *Session, text string) {
+	msg := fmt.Sprintf("[%s] %s", s.Name, text)
+
+	// Under one lock, so a joiner either has msg replayed or receives it
+	r.Lock()
+	defer r.Unlock()
+	r.history.add(msg)
+	r.broadcast(s, msg)
 }
 
-func names(sessions []Session) string {
+// Rename changes the name of s, a member of the room, and tells everyone else
+func (r *Room) Rename(s *Session, name string) {
+	r.Lock()
+	old := s.Name
+	s.Name = name
+	r.Unlock()
+
+	r.Broadcast(s, fmt.Sprintf("* %s is now known as %s", old, name))
+	log.Printf("3_budgetchat at=room.rename room=%s from=%s to=%s\n", r.Name, old, name)
+}
+
+// Len returns the number of sessions in the room
+func (r *Room) Len() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.sessions)
+}
+
+// Who describes everyone in the room
+func (r *Room) Who() string {
+	r.Lock()
+	defer r.Unlock()
+	return fmt.Sprintf("* %s contains: %s", r.Name, names(r.sessions))
+}
+
+func names(sessions []*Session) string {
 	r := []string{}
 	for _, s := range sessions {
 		r = append(r, s.Name)
@@ -46,14 +116,14 @@ func (r *Room) Leave(s *Session) {
 	r.Unlock()
 
 	r.Broadcast(s, fmt.Sprintf("* %s has left the room", s.Name))
-	log.Printf("3_budgetchat at=room.leave name=%s\n", s.Name)
+	log.Printf("3_budgetchat at=room.leave room=%s name=%s\n", r.Name, s.Name)
 }
 
-func removeSession(sessions []Session, sess *Session) []Session {
-	filtered := []Session{}
+func removeSession(sessions []*Session, sess *Session) []*Session {
+	filtered := []*Session{}
 
 	for _, s := range sessions {
-		if s.ID() != sess.ID() {
+		if s != sess {
 			filtered = append(filtered, s)
 		}
 	}
@@ -63,20 +133,31 @@ func removeSession(sessions []Session, sess *Session) []Session {
 
 func (r *Room) Broadcast(source *Session, msg string) {
 	r.Lock()
+	defer r.Unlock()
+	r.broadcast(source, msg)
+}
+
+// broadcast sends msg to everyone in the room but source. Sends never
+// block, so it's fine to hold the room's lock, which the caller must.
+func (r *Room) broadcast(source *Session, msg string) {
 	sessions := r.sessions
-	r.Unlock()
+	if r.transcript != nil {
+		if _, err := r.transcript.WriteString(transcriptLine(msg)); err != nil {
+			log.Printf("3_budgetchat at=room.transcript room=%s err=%q\n", r.Name, err.Error())
+		}
+	}
 
 	log.Printf("3_budgetchat at=room.msg name=%s msg=%d recp=%d\n", source.Name, len(msg), len(sessions))
 
 	for _, s := range sessions {
-		if source != nil && source.ID() == s.ID() {
+		if source == s {
 			continue
 		}
-		log.Printf("3_budgetchat at=room.broadcast to=%s msg=%d\n", s.Name, len(msg))
+		log.Printf("3_budgetchat at=room.broadcast to=%s msg=%d\n", s.ID(), len(msg))
 		if err := s.SendMessage(msg); err != nil {
 			log.Printf("3_budgetchat at=broadcast err=%q\n", err.Error())
 		}
-		log.Printf("3_budgetchat at=room.broadcast.done to=%s msg=%d\n", s.Name, len(msg))
+		log.Printf("3_budgetchat at=room.broadcast.done to=%s msg=%d\n", s.ID(), len(msg))
 	}
 
 	log.Printf("3_budgetchat at=room.msg.done name=%s msg=%d recp=%d\n", source.Name, len(msg), len(sessions))
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"log"
 	"net"
+	"net/http"
 	"regexp"
 	"sync"
 
@@ -17,10 +18,80 @@ type Server struct {
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
 
-	Room *Room
+	// WSAddr is where WebSocket clients connect, if enabled
+	WSAddr    string
+	wsAddr    string
+	ws        *http.Server
+	wsLock    sync.Mutex
+	wsClosing bool
+
+	Lobby  *Lobby
+	rooms  RoomConfig
+	policy Policy
+}
+
+type Option func(*Server)
+
+// WithHistory replays the last n chat messages to anyone joining a room
+func WithHistory(n int) Option {
+	return func(s *Server) {
+		s.rooms.HistorySize = n
+	}
+}
+
+// WithTranscriptDir appends a timestamped transcript of each room to a file
+// in dir
+func WithTranscriptDir(dir string) Option {
+	return func(s *Server) {
+		s.rooms.TranscriptDir = dir
+	}
+}
+
+// WithMaxMessageLength disconnects clients that send a line longer than n
+func WithMaxMessageLength(n int) Option {
+	return func(s *Server) {
+		s.policy.MaxMessageLength = n
+	}
+}
+
+// WithRateLimit lets each client send burst lines at once, refilling at
+// perSecond lines a second. Lines over the limit are dropped. Chat and /msg
+// count towards it; other commands don't.
+func WithRateLimit(perSecond float64, burst int) Option {
+	return func(s *Server) {
+		s.policy.RateLimit = perSecond
+		s.policy.Burst = burst
+	}
 }
 
-func NewServer(ctx context.Context, port string) (*Server, error) {
+// WithModerator vets every chat message with m before it is broadcast
+func WithModerator(m Moderator) Option {
+	return func(s *Server) {
+		s.policy.Moderator = m
+	}
+}
+
+// WithOperatorPassword lets clients that /oper with password /kick others
+func WithOperatorPassword(password string) Option {
+	return func(s *Server) {
+		s.policy.OperatorPassword = password
+	}
+}
+
+// WithWebSocket also serves chat over WebSocket on addr, one text message
+// per line, sharing rooms and names with TCP clients
+func WithWebSocket(addr string) Option {
+	return func(s *Server) {
+		s.wsAddr = addr
+	}
+}
+
+func NewServer(ctx context.Context, port string, opts ...Option) (*Server, error) {
+	s := &Server{}
+	for _, opt := range opts {
+		opt(s)
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 
 	var lc net.ListenConfig
@@ -34,7 +105,24 @@ func NewServer(ctx context.Context, port string) (*Server, error) {
 	l = &proxyproto.Listener{Listener: l}
 
 	log.Printf("3_budgetchat at=server.listening addr=%q\n", l.Addr().String())
-	s := &Server{Addr: l.Addr().String(), l: l, cancel: cancel, Room: NewRoom()}
+	s.Addr = l.Addr().String()
+	s.l = l
+	s.cancel = cancel
+	s.Lobby = NewLobby(s.rooms)
+	s.Lobby.Policy = s.policy
+
+	if s.wsAddr != "" {
+		wsl, err := lc.Listen(ctx, "tcp", s.wsAddr)
+		if err != nil {
+			l.Close()
+			cancel()
+			return nil, err
+		}
+		log.Printf("3_budgetchat at=server.websocket-listening addr=%q\n", wsl.Addr().String())
+		s.WSAddr = wsl.Addr().String()
+		s.ws = &http.Server{Handler: http.HandlerFunc(s.handleWebSocket)}
+		go s.serveWebSocket(wsl)
+	}
 
 	go s.acceptLoop(ctx)
 
@@ -47,6 +135,9 @@ func (s *Server) Close() error {
 
 	// Stop listening on port
 	s.l.Close()
+	if s.ws != nil {
+		s.closeWebSocket()
+	}
 
 	// Wait for all connections to gracefully close (allow systemd to sigkill us)
 	s.wg.Wait()
@@ -89,7 +180,7 @@ func (s *Server) handleConn(conn net.Conn) {
 	if err != nil {
 		log.Printf("3_budgetchat at=handle-connection.username remote-addr=%q err=%q\n", conn.RemoteAddr(), err.Error())
 	}
-	if err := sess.Loop(s.Room); err != nil {
+	if err := sess.Loop(s.Lobby); err != nil {
 		sess.SendMessage(err.Error())
 	}
 
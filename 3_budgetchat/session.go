@@ -2,20 +2,56 @@ package budgetchat
 
 import (
 	"bufio"
+	"crypto/subtle"
+	"errors"
 	"fmt"
+	"log"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// OutboundQueueSize is how many messages may wait for a slow client
+	// before it is disconnected
+	OutboundQueueSize = 128
+
+	writeTimeout = 10 * time.Second
+)
+
+var (
+	ErrQueueFull     = errors.New("outbound queue full")
+	ErrSessionClosed = errors.New("session closed")
 )
 
 type Session struct {
-	Name string
-	Room *Room
-	c    net.Conn
+	Name  string
+	Room  *Room
+	lobby *Lobby
+	c     net.Conn
+
+	operator bool
+	limiter  *tokenBucket
+	kickedBy atomic.Value
+
+	// Messages are queued in out and written by writeLoop, so a slow
+	// client never holds up whoever is sending to it
+	out       chan string
+	closing   chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 func NewSession(c net.Conn) (*Session, error) {
 	s := &Session{
-		c: c,
+		c:       c,
+		out:     make(chan string, OutboundQueueSize),
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
 	}
+	go s.writeLoop()
 	return s, nil
 }
 
@@ -23,34 +59,254 @@ func (c *Session) ID() string {
 	return c.c.RemoteAddr().String()
 }
 
-func (c *Session) Loop(r *Room) error {
+// Loop reads lines from the client until it leaves. The error it returns,
+// if any, is the last thing sent to the client, without the "* " that
+// marks notices sent to clients still chatting.
+func (c *Session) Loop(l *Lobby) error {
+	c.lobby = l
 	scanner := bufio.NewScanner(c.c)
+	if n := l.Policy.MaxMessageLength; n > 0 {
+		// Leave room for the line ending
+		scanner.Buffer(make([]byte, 0, 4096), n+2)
+	}
+	if l.Policy.RateLimit > 0 {
+		c.limiter = newTokenBucket(l.Policy.RateLimit, l.Policy.Burst)
+	}
 	for scanner.Scan() {
+		if n := l.Policy.MaxMessageLength; n > 0 && len(scanner.Bytes()) > n {
+			return fmt.Errorf("Message too long, the limit is %d characters", n)
+		}
 		// Initial message is their name
-		if c.Room == nil {
-			c.Name = scanner.Text()
-			if len(c.Name) == 0 {
+		if c.Name == "" {
+			name := scanner.Text()
+			if len(name) == 0 {
 				return fmt.Errorf("Username must contain at least 1 character")
-			} else if !isAlphaNumeric(c.Name) {
+			} else if !isAlphaNumeric(name) {
 				return fmt.Errorf("Username must consist entirely of alphanumeric characters")
 			}
-			r.Join(c)
-		} else {
-			msg := scanner.Text()
-			c.Room.Broadcast(c, fmt.Sprintf("[%s] %s", c.Name, msg))
+			if !l.Register(c, name) {
+				return fmt.Errorf("Username %s is already taken", name)
+			}
+			l.Join(c, DefaultRoom)
+		} else if msg := scanner.Text(); c.throttled(msg) {
+			c.SendMessage("* Slow down, you are sending messages too fast")
+		} else if isCommand(msg) {
+			c.handleCommand(msg)
+		} else if c.Room == nil {
+			c.SendMessage("* You are not in a room, /join one to chat")
+		} else if msg, ok := c.moderate(msg); ok {
+			c.Room.Post(c, msg)
 		}
 	}
+	if by, ok := c.kickedBy.Load().(string); ok {
+		return fmt.Errorf("You have been kicked by %s", by)
+	}
+	if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+		return fmt.Errorf("Message too long, the limit is %d characters", l.Policy.MaxMessageLength)
+	}
 	return scanner.Err()
 }
 
+// throttled reports whether msg is over the rate limit. Only lines that
+// reach other people count, so an operator can always /kick a flooder.
+func (c *Session) throttled(msg string) bool {
+	if c.limiter == nil {
+		return false
+	}
+	if isCommand(msg) && strings.Fields(msg)[0] != "/msg" {
+		return false
+	}
+	return !c.limiter.allow(time.Now())
+}
+
+// moderate runs msg past the lobby's moderator, reporting whether it
+// should be posted
+func (c *Session) moderate(msg string) (string, bool) {
+	m := c.lobby.Policy.Moderator
+	if m == nil {
+		return msg, true
+	}
+	msg, verdict := m.Moderate(c.Room.Name, c.Name, msg)
+	switch verdict {
+	case Drop:
+		log.Printf("3_budgetchat at=moderation.drop room=%s name=%s\n", c.Room.Name, c.Name)
+		c.SendMessage("* Your message was not delivered")
+		return "", false
+	case Flag:
+		log.Printf("3_budgetchat at=moderation.flag room=%s name=%s msg=%q\n", c.Room.Name, c.Name, msg)
+	}
+	return msg, true
+}
+
+// Kick disconnects the session, telling it who did so
+func (c *Session) Kick(by string) {
+	c.kickedBy.Store(by)
+	// Unblock Loop, which reports the kick and cleans up the session
+	c.c.SetReadDeadline(time.Now())
+}
+
+// commands are the slash commands handleCommand runs. Any other line is
+// chat, even if it starts with a slash.
+var commands = map[string]bool{
+	"/join": true, "/leave": true, "/rooms": true, "/who": true,
+	"/msg": true, "/nick": true, "/oper": true, "/kick": true,
+}
+
+func isCommand(msg string) bool {
+	fields := strings.Fields(msg)
+	return len(fields) > 0 && commands[fields[0]]
+}
+
+// handleCommand runs a slash command: /join <room>, /leave, /rooms, /who,
+// /msg <name> <text>, /nick <name>, /oper <password> or /kick <name>
+func (c *Session) handleCommand(msg string) {
+	fields := strings.Fields(msg)
+	switch fields[0] {
+	case "/join":
+		if len(fields) != 2 || !isAlphaNumeric(fields[1]) {
+			c.SendMessage("* Usage: /join <room>, where room is alphanumeric")
+			return
+		}
+		if c.Room != nil && c.Room.Name == fields[1] {
+			c.SendMessage(fmt.Sprintf("* You are already in %s", fields[1]))
+			return
+		}
+		c.lobby.Leave(c)
+		c.lobby.Join(c, fields[1])
+	case "/leave":
+		if c.Room == nil {
+			c.SendMessage("* You are not in a room")
+			return
+		}
+		name := c.Room.Name
+		c.lobby.Leave(c)
+		c.SendMessage(fmt.Sprintf("* You have left %s", name))
+	case "/rooms":
+		c.SendMessage(c.lobby.Describe())
+	case "/who":
+		if c.Room == nil {
+			c.SendMessage("* You are not in a room")
+			return
+		}
+		c.SendMessage(c.Room.Who())
+	case "/msg":
+		parts := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(msg, "/msg")), " ", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			c.SendMessage("* Usage: /msg <name> <text>")
+			return
+		}
+		to := c.lobby.Find(parts[0])
+		if to == nil {
+			c.SendMessage(fmt.Sprintf("* No such user: %s", parts[0]))
+			return
+		}
+		if err := to.SendMessage(fmt.Sprintf("[%s -> %s] %s", c.Name, parts[0], parts[1])); err != nil {
+			log.Printf("3_budgetchat at=session.msg err=%q\n", err.Error())
+		}
+	case "/nick":
+		if len(fields) != 2 || !isAlphaNumeric(fields[1]) {
+			c.SendMessage("* Usage: /nick <name>, where name is alphanumeric")
+			return
+		}
+		if fields[1] == c.Name {
+			return
+		}
+		if !c.lobby.Rename(c, fields[1]) {
+			c.SendMessage(fmt.Sprintf("* Username %s is already taken", fields[1]))
+			return
+		}
+		c.SendMessage(fmt.Sprintf("* You are now known as %s", c.Name))
+	case "/oper":
+		password := c.lobby.Policy.OperatorPassword
+		if password == "" {
+			c.SendMessage("* Operator access is disabled")
+			return
+		}
+		if len(fields) != 2 || subtle.ConstantTimeCompare([]byte(fields[1]), []byte(password)) != 1 {
+			log.Printf("3_budgetchat at=session.oper-failed id=%s name=%s\n", c.ID(), c.Name)
+			c.SendMessage("* Permission denied")
+			return
+		}
+		c.operator = true
+		c.SendMessage("* You are now an operator")
+	case "/kick":
+		if !c.operator {
+			c.SendMessage("* Permission denied")
+			return
+		}
+		if len(fields) != 2 {
+			c.SendMessage("* Usage: /kick <name>")
+			return
+		}
+		to := c.lobby.Find(fields[1])
+		if to == nil {
+			c.SendMessage(fmt.Sprintf("* No such user: %s", fields[1]))
+			return
+		}
+		log.Printf("3_budgetchat at=session.kick name=%s by=%s\n", fields[1], c.Name)
+		to.Kick(c.Name)
+		c.SendMessage(fmt.Sprintf("* Kicked %s", fields[1]))
+	}
+}
+
+// SendMessage queues s for delivery without blocking. A client that has
+// fallen so far behind that its queue is full is disconnected.
 func (c *Session) SendMessage(s string) error {
-	_, err := c.c.Write([]byte(s + "\n"))
+	select {
+	case <-c.closing:
+		return ErrSessionClosed
+	default:
+	}
+
+	select {
+	case c.out <- s:
+		return nil
+	default:
+		log.Printf("3_budgetchat at=session.overflow id=%s\n", c.ID())
+		// Closing the connection ends Loop, which cleans up the session
+		c.c.Close()
+		return ErrQueueFull
+	}
+}
+
+func (c *Session) writeLoop() {
+	defer close(c.closed)
+	defer c.c.Close()
+
+	for {
+		select {
+		case msg := <-c.out:
+			if err := c.write(msg); err != nil {
+				log.Printf("3_budgetchat at=session.write id=%s err=%q\n", c.ID(), err.Error())
+				return
+			}
+		case <-c.closing:
+			// Flush whatever was queued before the session closed
+			for {
+				select {
+				case msg := <-c.out:
+					if err := c.write(msg); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *Session) write(msg string) error {
+	c.c.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.c.Write([]byte(msg + "\n"))
 	return err
 }
 
 func (c *Session) Close() {
-	if c.Room != nil {
-		c.Room.Leave(c)
+	if c.lobby != nil {
+		c.lobby.Leave(c)
+		c.lobby.Unregister(c)
 	}
-	c.c.Close()
+	c.closeOnce.Do(func() { close(c.closing) })
+	<-c.closed
 }
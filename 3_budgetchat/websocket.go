@@ -0,0 +1,114 @@
+package budgetchat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	// Browsers on any page may join the chat
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// serveWebSocket accepts chat sessions over WebSocket on l until the server
+// closes
+func (s *Server) serveWebSocket(l net.Listener) {
+	if err := s.ws.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+		log.Printf("3_budgetchat at=websocket.serve err=%q\n", err)
+	}
+}
+
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// Once Close is waiting on the sessions, no more may start
+	s.wsLock.Lock()
+	if s.wsClosing {
+		s.wsLock.Unlock()
+		http.Error(w, "server closing", http.StatusServiceUnavailable)
+		return
+	}
+	s.wg.Add(1)
+	s.wsLock.Unlock()
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("3_budgetchat at=websocket.upgrade err=%q\n", err)
+		s.wg.Done()
+		return
+	}
+	go func() {
+		s.handleConn(newWSConn(ws))
+		s.wg.Done()
+	}()
+}
+
+// closeWebSocket stops accepting WebSocket sessions, waiting for any being
+// upgraded
+func (s *Server) closeWebSocket() {
+	s.wsLock.Lock()
+	s.wsClosing = true
+	s.wsLock.Unlock()
+
+	if err := s.ws.Shutdown(context.Background()); err != nil {
+		log.Printf("3_budgetchat at=websocket.shutdown err=%q\n", err)
+	}
+}
+
+// wsConn adapts a WebSocket to the line-based net.Conn a Session expects.
+// Each text message received reads as one line, and each line written is
+// sent as one text message.
+type wsConn struct {
+	ws      *websocket.Conn
+	reading []byte
+	writing []byte
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	return &wsConn{ws: ws}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.reading) == 0 {
+		_, msg, err := c.ws.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.reading = append(bytes.TrimRight(msg, "\r\n"), '\n')
+	}
+	n := copy(p, c.reading)
+	c.reading = c.reading[n:]
+	return n, nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.writing = append(c.writing, p...)
+	for {
+		i := bytes.IndexByte(c.writing, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		if err := c.ws.WriteMessage(websocket.TextMessage, c.writing[:i]); err != nil {
+			return 0, err
+		}
+		c.writing = c.writing[i+1:]
+	}
+}
+
+func (c *wsConn) Close() error                       { return c.ws.Close() }
+func (c *wsConn) LocalAddr() net.Addr                { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr               { return c.ws.RemoteAddr() }
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
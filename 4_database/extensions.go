@@ -0,0 +1,167 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With extensions enabled, keys starting with a NUL byte are reserved for
+// these special retrieves:
+//
+//	\x00keys           lists every key
+//	\x00keys:<prefix>  lists the keys starting with prefix
+//	\x00value:<key>    fetches a value too large for one response
+//	\x00stats          reports the entry count and memory use
+//
+// Listings and values are paginated. Each retrieve is answered with a single
+// datagram holding one page, the first unless another is asked for by
+// adding "@<page>", such as \x00keys:user:@2. A prefix or key containing
+// '@' needs its page given explicitly. The response is of the form
+// "<request>=<page>/<pages>\n<payload>", or "<request>=" if there is no such
+// page. A listing's payload is one Go-quoted key per line; a value's is the
+// next chunk of it.
+const extensionPrefix = "\x00"
+
+// maxResponseSize keeps responses under the protocol's 1000 byte limit. A
+// page holds at least one key, so a key too long to share a page with its
+// header makes for a longer datagram.
+const maxResponseSize = 999
+
+// statsInterval is the longest stats are reused for. Working them out means
+// walking the database and stopping the world to read memory use, which
+// every sender shouldn't be able to make us do on every packet.
+const statsInterval = time.Second
+
+// minChunkSize is the least of a value sent per page, however long its key
+const minChunkSize = 256
+
+func isExtension(key string) bool {
+	return strings.HasPrefix(key, extensionPrefix)
+}
+
+// handleExtension answers a retrieve of a reserved key. It only ever sends
+// one datagram, so can't be used to flood a spoofed address.
+func (s *Server) handleExtension(key string, addr net.Addr) {
+	request, page := splitPage(key)
+	var response string
+	switch {
+	case request == "\x00keys" || strings.HasPrefix(request, "\x00keys:"):
+		prefix := strings.TrimPrefix(request[len("\x00keys"):], ":")
+		response = formatPage(key, page, paginateKeys(request, s.keys(prefix)))
+	case strings.HasPrefix(request, "\x00value:"):
+		s.dbLock.Lock()
+		value := s.db[request[len("\x00value:"):]]
+		s.dbLock.Unlock()
+		response = formatPage(key, page, paginateValue(request, value))
+	case key == "\x00stats":
+		response = fmt.Sprintf("%s=%s", key, s.stats())
+	default:
+		response = key + "="
+	}
+
+	if _, err := s.l.WriteTo([]byte(response), addr); err != nil {
+		log.Printf("4_database at=handle-packet.finish action=write-err key=%q remote-addr=%q err=%s\n", key, addr, err)
+		return
+	}
+	log.Printf("4_database at=handle-packet.finish action=extension key=%q remote-addr=%q\n", key, addr)
+}
+
+// splitPage splits the page asked for off the end of a request, defaulting
+// to the first
+func splitPage(key string) (string, int) {
+	if i := strings.LastIndexByte(key, '@'); i >= 0 {
+		if page, err := strconv.Atoi(key[i+1:]); err == nil && page > 0 {
+			return key[:i], page
+		}
+	}
+	return key, 1
+}
+
+// keys returns the sorted keys starting with prefix
+func (s *Server) keys(prefix string) []string {
+	s.dbLock.Lock()
+	keys := []string{}
+	for key := range s.db {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	s.dbLock.Unlock()
+
+	sort.Strings(keys)
+	return keys
+}
+
+// stats reports on the database, working it out at most once a statsInterval
+func (s *Server) stats() string {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	if time.Since(s.statsAt) < statsInterval {
+		return s.statsCache
+	}
+
+	s.dbLock.Lock()
+	entries, size := len(s.db), 0
+	for key, value := range s.db {
+		size += len(key) + len(value)
+	}
+	s.dbLock.Unlock()
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	s.statsCache = fmt.Sprintf("entries=%d bytes=%d heap=%d", entries, size, m.HeapAlloc)
+	s.statsAt = time.Now()
+	return s.statsCache
+}
+
+// pageHeaderSize is the most room the header of any of up to n pages for
+// request can take, including the page asked for in the request itself
+func pageHeaderSize(request string, n int) int {
+	digits := len(strconv.Itoa(n))
+	return len(request) + len("@=/\n") + 3*digits
+}
+
+// formatPage answers key with the given page of payloads
+func formatPage(key string, page int, payloads []string) string {
+	if page > len(payloads) {
+		return key + "="
+	}
+	return fmt.Sprintf("%s=%d/%d\n%s", key, page, len(payloads), payloads[page-1])
+}
+
+func paginateKeys(request string, keys []string) []string {
+	budget := maxResponseSize - pageHeaderSize(request, len(keys))
+
+	payloads := []string{""}
+	for _, key := range keys {
+		line := strconv.Quote(key) + "\n"
+		last := &payloads[len(payloads)-1]
+		if *last != "" && len(*last)+len(line) > budget {
+			payloads = append(payloads, "")
+			last = &payloads[len(payloads)-1]
+		}
+		*last += line
+	}
+	return payloads
+}
+
+func paginateValue(request, value string) []string {
+	chunk := maxResponseSize - pageHeaderSize(request, len(value))
+	if chunk < minChunkSize {
+		chunk = minChunkSize
+	}
+
+	payloads := []string{}
+	for len(value) > chunk {
+		payloads = append(payloads, value[:chunk])
+		value = value[chunk:]
+	}
+	payloads = append(payloads, value)
+	return payloads
+}
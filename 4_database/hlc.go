@@ -0,0 +1,70 @@
+package database
+
+import (
+	"sync"
+	"time"
+)
+
+// Timestamp is a hybrid logical clock reading. Wall is physical time in
+// nanoseconds, Logical orders events within the same Wall, and Node breaks
+// ties between nodes so that every timestamp is unique.
+type Timestamp struct {
+	Wall    int64  `json:"wall"`
+	Logical uint32 `json:"logical"`
+	Node    string `json:"node"`
+}
+
+// Less reports whether t happened before u
+func (t Timestamp) Less(u Timestamp) bool {
+	if t.Wall != u.Wall {
+		return t.Wall < u.Wall
+	}
+	if t.Logical != u.Logical {
+		return t.Logical < u.Logical
+	}
+	return t.Node < u.Node
+}
+
+// Clock is a hybrid logical clock. Its readings follow physical time but
+// never go backwards, and always follow any reading it has seen from
+// another node.
+type Clock struct {
+	mu   sync.Mutex
+	last Timestamp
+	now  func() time.Time
+}
+
+func NewClock(node string) *Clock {
+	return &Clock{last: Timestamp{Node: node}, now: time.Now}
+}
+
+// Now returns a timestamp for a local event
+func (c *Clock) Now() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if pt := c.now().UnixNano(); pt > c.last.Wall {
+		c.last.Wall, c.last.Logical = pt, 0
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// Update moves the clock past a timestamp received from another node
+func (c *Clock) Update(remote Timestamp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pt := c.now().UnixNano()
+	switch {
+	case pt > c.last.Wall && pt > remote.Wall:
+		c.last.Wall, c.last.Logical = pt, 0
+	case remote.Wall > c.last.Wall:
+		c.last.Wall, c.last.Logical = remote.Wall, remote.Logical+1
+	case remote.Wall == c.last.Wall && remote.Logical >= c.last.Logical:
+		c.last.Logical = remote.Logical + 1
+	default:
+		c.last.Logical++
+	}
+}
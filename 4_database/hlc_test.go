@@ -0,0 +1,36 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	wall := time.Unix(100, 0)
+	c := NewClock("a")
+	c.now = func() time.Time { return wall }
+
+	t1 := c.Now()
+	t2 := c.Now()
+	if !t1.Less(t2) || t2.Wall != t1.Wall || t2.Logical != 1 {
+		t.Errorf("readings at the same wall time should count up: %+v then %+v", t1, t2)
+	}
+
+	// A reading from a node whose clock is ahead pulls ours forward
+	remote := Timestamp{Wall: wall.Add(time.Second).UnixNano(), Logical: 5, Node: "b"}
+	c.Update(remote)
+	if t3 := c.Now(); !remote.Less(t3) {
+		t.Errorf("reading %+v should follow remote %+v", t3, remote)
+	}
+
+	// Once physical time passes everything seen, it takes over again
+	wall = wall.Add(time.Minute)
+	if t4 := c.Now(); t4.Wall != wall.UnixNano() || t4.Logical != 0 {
+		t.Errorf("reading %+v should be physical time", t4)
+	}
+
+	// Identical readings on different nodes are ordered by node
+	if !(Timestamp{Wall: 1, Node: "a"}).Less(Timestamp{Wall: 1, Node: "b"}) {
+		t.Error("ties should be broken by node")
+	}
+}
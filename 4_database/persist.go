@@ -0,0 +1,284 @@
+package database
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotFile = "snapshot"
+	logFile      = "inserts.log"
+	oldLogFile   = "inserts.log.old" // set aside while a snapshot is written
+
+	defaultSnapshotInterval = time.Minute
+	logSyncInterval         = time.Second
+)
+
+// Both the snapshot and the insert log hold one entry per line, key then
+// value, each Go-quoted so that any bytes survive the round trip. When
+// replicating, the time the value was written follows, so that it still
+// wins against older writes from peers after a restart.
+
+// entry is a value and, when replicating, the time it was written
+type entry struct {
+	value string
+	time  Timestamp
+}
+
+func formatEntry(key string, e entry) string {
+	line := strconv.Quote(key) + " " + strconv.Quote(e.value)
+	if e.time != (Timestamp{}) {
+		line += fmt.Sprintf(" %d %d %s", e.time.Wall, e.time.Logical, strconv.Quote(e.time.Node))
+	}
+	return line + "\n"
+}
+
+func parseEntry(line string) (key string, e entry, err error) {
+	k, err := strconv.QuotedPrefix(line)
+	if err != nil {
+		return "", entry{}, err
+	}
+	line = line[len(k):]
+	if !strings.HasPrefix(line, " ") {
+		return "", entry{}, fmt.Errorf("missing value")
+	}
+	v, err := strconv.QuotedPrefix(line[1:])
+	if err != nil {
+		return "", entry{}, err
+	}
+	line = line[1+len(v):]
+	if key, err = strconv.Unquote(k); err != nil {
+		return "", entry{}, err
+	}
+	if e.value, err = strconv.Unquote(v); err != nil {
+		return "", entry{}, err
+	}
+	if line != "" {
+		if _, err := fmt.Sscanf(line, " %d %d %q", &e.time.Wall, &e.time.Logical, &e.time.Node); err != nil {
+			return "", entry{}, fmt.Errorf("bad time: %w", err)
+		}
+	}
+	return key, e, nil
+}
+
+// load reads the snapshot and then replays the insert logs on top of it
+func (s *Server) load() error {
+	for _, name := range []string{snapshotFile, oldLogFile, logFile} {
+		path := filepath.Join(s.dataDir, name)
+		n, torn, err := s.loadFile(path)
+		if err != nil {
+			return err
+		}
+		log.Printf("4_database at=load file=%q entries=%d\n", name, n)
+
+		if torn >= 0 {
+			// A crash mid-append leaves a torn last line, which must go
+			// before anything is appended after it
+			log.Printf("4_database at=load.torn file=%q\n", name)
+			if err := os.Truncate(path, torn); err != nil {
+				return err
+			}
+		}
+	}
+
+	// A crash while snapshotting leaves the old log behind. Fold it into a
+	// snapshot now, before the next one sets another log aside over it.
+	if _, err := os.Stat(filepath.Join(s.dataDir, oldLogFile)); err == nil {
+		if err := s.writeSnapshot(s.entries()); err != nil {
+			return err
+		}
+		if err := os.Truncate(filepath.Join(s.dataDir, logFile), 0); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return os.Remove(filepath.Join(s.dataDir, oldLogFile))
+	}
+	return nil
+}
+
+// loadFile reads entries from path into the database, returning how many
+// there were and, if the last line is incomplete, the offset it starts at
+func (s *Server) loadFile(path string) (n int, torn int64, err error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, -1, nil
+	} else if err != nil {
+		return 0, -1, err
+	}
+	defer f.Close()
+
+	var offset int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			if line != "" {
+				return n, offset, nil
+			}
+			return n, -1, nil
+		} else if err != nil {
+			return n, -1, err
+		}
+		offset += int64(len(line))
+
+		key, e, err := parseEntry(strings.TrimSuffix(line, "\n"))
+		if err != nil {
+			return n, -1, fmt.Errorf("%s: entry %d: %w", path, n+1, err)
+		}
+		// version always reports this server, not whatever was saved
+		if key != "version" {
+			s.db[key] = e.value
+			if e.time != (Timestamp{}) {
+				s.stamps[key] = e.time
+			}
+		}
+		n++
+	}
+}
+
+// openLog opens the insert log for appending
+func (s *Server) openLog() error {
+	f, err := os.OpenFile(filepath.Join(s.dataDir, logFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.insertLog = f
+	return nil
+}
+
+// appendLog records an insert, written at ts if replicating. The caller
+// must hold dbLock.
+func (s *Server) appendLog(key, value string, ts Timestamp) {
+	if s.insertLog == nil {
+		return
+	}
+	if _, err := s.insertLog.WriteString(formatEntry(key, entry{value, ts})); err != nil {
+		log.Printf("4_database at=append-log err=%q\n", err)
+	}
+}
+
+// snapshot writes the whole database to disk and empties the insert log.
+// Only copying the database holds up inserts; it's written out from the copy.
+func (s *Server) snapshot() error {
+	s.snapshotLock.Lock()
+	defer s.snapshotLock.Unlock()
+
+	s.dbLock.Lock()
+	entries := s.entries()
+	err := s.rotateLog()
+	s.dbLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := s.writeSnapshot(entries); err != nil {
+		return err
+	}
+	// Everything in the old log is now in the snapshot
+	return os.Remove(filepath.Join(s.dataDir, oldLogFile))
+}
+
+// entries returns a copy of the database to snapshot. The caller must hold
+// dbLock, if the database is in use.
+func (s *Server) entries() map[string]entry {
+	entries := make(map[string]entry, len(s.db))
+	for key, value := range s.db {
+		if key != "version" {
+			entries[key] = entry{value, s.stamps[key]}
+		}
+	}
+	return entries
+}
+
+// rotateLog sets the insert log aside until a snapshot holds everything in
+// it, and starts a new one. The caller must hold dbLock.
+func (s *Server) rotateLog() error {
+	if err := s.insertLog.Sync(); err != nil {
+		return err
+	}
+	path, old := filepath.Join(s.dataDir, logFile), filepath.Join(s.dataDir, oldLogFile)
+	if err := os.Rename(path, old); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		// Carry on with the log we had
+		os.Rename(old, path)
+		return err
+	}
+	s.insertLog.Close()
+	s.insertLog = f
+	return nil
+}
+
+// writeSnapshot durably replaces the snapshot with entries
+func (s *Server) writeSnapshot(entries map[string]entry) error {
+	tmp, err := os.CreateTemp(s.dataDir, snapshotFile+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for key, e := range entries {
+		w.WriteString(formatEntry(key, e))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dataDir, snapshotFile))
+}
+
+// syncLog flushes the insert log to disk, so no more than logSyncInterval
+// of inserts is lost if the machine goes down
+func (s *Server) syncLog() error {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+	if s.insertLog == nil {
+		return nil
+	}
+	return s.insertLog.Sync()
+}
+
+// snapshotLoop snapshots the database every interval, if it's positive,
+// and syncs the insert log in between
+func (s *Server) snapshotLoop(ctx context.Context, interval time.Duration) {
+	var snapshots <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		snapshots = t.C
+	}
+	logSyncs := time.NewTicker(logSyncInterval)
+	defer logSyncs.Stop()
+	for {
+		select {
+		case <-snapshots:
+			if err := s.snapshot(); err != nil {
+				log.Printf("4_database at=snapshot err=%q\n", err)
+			}
+		case <-logSyncs.C:
+			if err := s.syncLog(); err != nil {
+				log.Printf("4_database at=sync-log err=%q\n", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package database
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// Nodes replicate to each other over TCP, one JSON message per line. Each
+// node dials every peer it knows of, asks it for a full sync, and then
+// forwards its own inserts down that connection, including any queued while
+// it was disconnected. Peers should therefore form a full mesh: a node does
+// not pass on inserts it receives. Entries are applied at most once per
+// timestamp, so receiving one twice is harmless.
+
+const (
+	peerQueueSize   = 4096
+	peerDialTimeout = 5 * time.Second
+	peerMaxBackoff  = 5 * time.Second
+)
+
+type peerMessage struct {
+	// Type is "sync" to ask for every entry, or "entry" for one of them
+	Type  string    `json:"type"`
+	Key   []byte    `json:"key,omitempty"`
+	Value []byte    `json:"value,omitempty"`
+	Time  Timestamp `json:"time"`
+}
+
+type peer struct {
+	addr  string
+	queue chan peerMessage
+}
+
+// AddPeer starts replicating to the node whose peer address is addr
+func (s *Server) AddPeer(addr string) {
+	if s.peerListener == nil {
+		return
+	}
+	p := &peer{addr: addr, queue: make(chan peerMessage, peerQueueSize)}
+
+	s.peersLock.Lock()
+	s.peers = append(s.peers, p)
+	s.peersLock.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		s.peerLoop(s.ctx, p)
+		s.wg.Done()
+	}()
+}
+
+// replicate forwards a local insert to every peer
+func (s *Server) replicate(key, value string, ts Timestamp) {
+	msg := peerMessage{Type: "entry", Key: []byte(key), Value: []byte(value), Time: ts}
+
+	s.peersLock.Lock()
+	defer s.peersLock.Unlock()
+	for _, p := range s.peers {
+		select {
+		case p.queue <- msg:
+		default:
+			log.Printf("4_database at=replicate.dropped peer=%q key=%q\n", p.addr, key)
+		}
+	}
+}
+
+// merge applies an entry from a peer if it is newer than what we have
+func (s *Server) merge(key, value string, ts Timestamp) {
+	if key == "version" {
+		return
+	}
+	s.clock.Update(ts)
+
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+	if cur, ok := s.stamps[key]; ok && !cur.Less(ts) {
+		return
+	}
+	s.db[key] = value
+	s.stamps[key] = ts
+	s.appendLog(key, value, ts)
+}
+
+// peerLoop keeps a connection open to p, syncing from it every time it
+// connects and then sending it our inserts
+func (s *Server) peerLoop(ctx context.Context, p *peer) {
+	d := net.Dialer{Timeout: peerDialTimeout}
+	backoff := 100 * time.Millisecond
+	for {
+		conn, err := d.DialContext(ctx, "tcp", p.addr)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("4_database at=peer.dial peer=%q backoff=%s err=%q\n", p.addr, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			if backoff *= 2; backoff > peerMaxBackoff {
+				backoff = peerMaxBackoff
+			}
+			continue
+		}
+		backoff = 100 * time.Millisecond
+		log.Printf("4_database at=peer.connected peer=%q\n", p.addr)
+
+		if err := s.sendToPeer(ctx, conn, p); err != nil && ctx.Err() == nil {
+			log.Printf("4_database at=peer.disconnected peer=%q err=%q\n", p.addr, err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// sendToPeer asks the peer on conn for a sync, then sends it our inserts
+// until either side hangs up. conn is closed when it returns.
+func (s *Server) sendToPeer(ctx context.Context, conn net.Conn, p *peer) error {
+	// The sync, and nothing else, comes back on this connection
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- s.readPeer(conn)
+	}()
+	defer func() {
+		conn.Close()
+		if readErr != nil {
+			<-readErr
+		}
+	}()
+
+	enc := json.NewEncoder(conn)
+	if err := enc.Encode(peerMessage{Type: "sync"}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case msg := <-p.queue:
+			if err := enc.Encode(msg); err != nil {
+				return err
+			}
+		case err := <-readErr:
+			readErr = nil
+			if err == nil {
+				err = errors.New("connection closed by peer")
+			}
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// readPeer merges entries sent on conn, answering any sync requests
+func (s *Server) readPeer(conn net.Conn) error {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), 1<<20)
+	for scanner.Scan() {
+		var msg peerMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return err
+		}
+		switch msg.Type {
+		case "entry":
+			s.merge(string(msg.Key), string(msg.Value), msg.Time)
+		case "sync":
+			if err := s.sendSync(conn); err != nil {
+				return err
+			}
+		default:
+			log.Printf("4_database at=peer.unknown-message type=%q\n", msg.Type)
+		}
+	}
+	return scanner.Err()
+}
+
+// sendSync writes every entry to conn
+func (s *Server) sendSync(conn net.Conn) error {
+	s.dbLock.Lock()
+	msgs := make([]peerMessage, 0, len(s.db))
+	for key, value := range s.db {
+		if key == "version" {
+			continue
+		}
+		// Entries from before we replicated have a zero timestamp, so
+		// lose to any the peer has
+		msgs = append(msgs, peerMessage{Type: "entry", Key: []byte(key), Value: []byte(value), Time: s.stamps[key]})
+	}
+	s.dbLock.Unlock()
+
+	w := bufio.NewWriter(conn)
+	enc := json.NewEncoder(w)
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// peerAcceptLoop serves sync requests and inserts from other nodes
+func (s *Server) peerAcceptLoop() {
+	for {
+		conn, err := s.peerListener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("4_database at=peer.accept err=%q\n", err)
+			continue
+		}
+
+		s.peersLock.Lock()
+		if s.peersClosed {
+			s.peersLock.Unlock()
+			conn.Close()
+			continue
+		}
+		s.peerConns[conn] = struct{}{}
+		s.peersLock.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			if err := s.readPeer(conn); err != nil {
+				log.Printf("4_database at=peer.read remote-addr=%q err=%q\n", conn.RemoteAddr(), err)
+			}
+			conn.Close()
+
+			s.peersLock.Lock()
+			delete(s.peerConns, conn)
+			s.peersLock.Unlock()
+			s.wg.Done()
+		}()
+	}
+}
+
+// closePeers stops replication, disconnecting every peer
+func (s *Server) closePeers() {
+	s.peerListener.Close()
+
+	s.peersLock.Lock()
+	defer s.peersLock.Unlock()
+	s.peersClosed = true
+	for conn := range s.peerConns {
+		conn.Close()
+	}
+}
@@ -7,33 +7,183 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"runtime"
 	"sync"
+	"time"
 )
 
 type Server struct {
 	Addr   string
 	l      net.PacketConn
+	ctx    context.Context
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
 
 	dbLock sync.Mutex
 	db     map[string]string
+
+	workers    int
+	extensions bool
+	statsLock  sync.Mutex
+	statsCache string    // guarded by statsLock
+	statsAt    time.Time // when statsCache was worked out
+
+	dataDir          string
+	snapshotInterval time.Duration
+	snapshotLock     sync.Mutex // one snapshot at a time
+	insertLog        *os.File   // guarded by dbLock
+
+	// PeerAddr is where other nodes replicate to us, if replicating
+	PeerAddr     string
+	peerAddr     string
+	initialPeers []string
+	peerListener net.Listener
+	clock        *Clock
+	stamps       map[string]Timestamp
+	peersLock    sync.Mutex
+	peers        []*peer
+	peerConns    map[net.Conn]struct{}
+	peersClosed  bool
+}
+
+type Option func(*Server)
+
+// WithDataDir keeps the database in dir, recovering it from there on start
+func WithDataDir(dir string) Option {
+	return func(s *Server) {
+		s.dataDir = dir
+	}
 }
 
-func NewServer(ctx context.Context, addr string) (*Server, error) {
+// WithSnapshotInterval sets how often the database is snapshotted to its
+// data dir, folding in the insert log
+func WithSnapshotInterval(d time.Duration) Option {
+	return func(s *Server) {
+		s.snapshotInterval = d
+	}
+}
+
+// WithReplication listens for other nodes on addr and replicates every
+// insert to peers, keeping the most recent write to each key
+func WithReplication(addr string, peers ...string) Option {
+	return func(s *Server) {
+		s.peerAddr = addr
+		s.initialPeers = peers
+	}
+}
+
+// WithExtensions reserves keys starting with a NUL byte for listing keys,
+// fetching large values and reporting stats
+func WithExtensions() Option {
+	return func(s *Server) {
+		s.extensions = true
+	}
+}
+
+// WithWorkers handles up to n packets at once
+func WithWorkers(n int) Option {
+	return func(s *Server) {
+		s.workers = n
+	}
+}
+
+func NewServer(ctx context.Context, addr string, opts ...Option) (*Server, error) {
+	s := &Server{
+		workers:          runtime.NumCPU(),
+		db:               map[string]string{"version": "fanatic/protohackers"},
+		stamps:           map[string]Timestamp{},
+		snapshotInterval: defaultSnapshotInterval,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.dataDir != "" {
+		if err := os.MkdirAll(s.dataDir, 0o755); err != nil {
+			return nil, err
+		}
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+		if err := s.openLog(); err != nil {
+			return nil, err
+		}
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 
 	var lc net.ListenConfig
 	l, err := lc.ListenPacket(ctx, "udp", addr)
 	if err != nil {
 		cancel()
+		if s.insertLog != nil {
+			s.insertLog.Close()
+		}
 		return nil, err
 	}
 
 	log.Printf("4_database at=server.listening addr=%q\n", l.LocalAddr().String())
-	s := &Server{Addr: l.LocalAddr().String(), l: l, cancel: cancel, db: map[string]string{"version": "fanatic/protohackers"}}
+	s.Addr = l.LocalAddr().String()
+	s.l = l
+	s.ctx = ctx
+	s.cancel = cancel
+
+	if s.peerAddr != "" {
+		pl, err := lc.Listen(ctx, "tcp", s.peerAddr)
+		if err != nil {
+			cancel()
+			l.Close()
+			if s.insertLog != nil {
+				s.insertLog.Close()
+			}
+			return nil, err
+		}
+		log.Printf("4_database at=server.peer-listening addr=%q\n", pl.Addr().String())
+		s.PeerAddr = pl.Addr().String()
+		s.peerListener = pl
+		s.clock = NewClock(s.PeerAddr)
+		// Stay ahead of every write recovered from disk
+		for _, ts := range s.stamps {
+			s.clock.Update(ts)
+		}
+		s.peerConns = map[net.Conn]struct{}{}
+
+		s.wg.Add(1)
+		go func() {
+			s.peerAcceptLoop()
+			s.wg.Done()
+		}()
+		for _, addr := range s.initialPeers {
+			s.AddPeer(addr)
+		}
+	}
 
-	go s.acceptLoop(ctx)
+	if s.insertLog != nil {
+		s.wg.Add(1)
+		go func() {
+			s.snapshotLoop(ctx, s.snapshotInterval)
+			s.wg.Done()
+		}()
+	}
+
+	if s.workers < 1 {
+		s.workers = 1
+	}
+	packets := make(chan packet, s.workers)
+	s.wg.Add(s.workers)
+	for i := 0; i < s.workers; i++ {
+		go func() {
+			s.worker(packets)
+			s.wg.Done()
+		}()
+	}
+
+	s.wg.Add(1)
+	go func() {
+		s.acceptLoop(ctx, packets)
+		s.wg.Done()
+	}()
 
 	return s, nil
 }
@@ -44,37 +194,76 @@ func (s *Server) Close() error {
 
 	// Stop listening on port
 	s.l.Close()
+	if s.peerListener != nil {
+		s.closePeers()
+	}
 
-	// Wait for all connections to gracefully close (allow systemd to sigkill us)
+	// Wait for all connections to gracefully close (allow systemd to sigkill us).
+	// This includes every packet handler, so nothing appends to the log after.
 	s.wg.Wait()
+
+	if s.insertLog != nil {
+		if err := s.snapshot(); err != nil {
+			log.Printf("4_database at=snapshot err=%q\n", err)
+		}
+		s.dbLock.Lock()
+		defer s.dbLock.Unlock()
+		err := s.insertLog.Close()
+		s.insertLog = nil
+		return err
+	}
 	return nil
 }
 
-func (s *Server) acceptLoop(ctx context.Context) {
-	packet := make([]byte, 1000)
+// maxPacketSize bounds requests, which the protocol keeps under 1000 bytes
+const maxPacketSize = 1000
+
+var packetPool = sync.Pool{
+	New: func() any { return new([maxPacketSize]byte) },
+}
+
+// packet is a datagram waiting for a worker. Whoever holds it owns buf and
+// must return it to packetPool once finished with it.
+type packet struct {
+	buf  *[maxPacketSize]byte
+	n    int
+	addr net.Addr
+}
+
+// acceptLoop reads each datagram into its own pooled buffer and hands it
+// to a worker, so no buffer is ever read into while a worker is using it
+func (s *Server) acceptLoop(ctx context.Context, packets chan<- packet) {
+	defer close(packets)
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
-			n, addr, err := s.l.ReadFrom(packet)
+			buf := packetPool.Get().(*[maxPacketSize]byte)
+			n, addr, err := s.l.ReadFrom(buf[:])
 			if errors.Is(err, net.ErrClosed) {
+				packetPool.Put(buf)
 				return
 			}
 			if err != nil {
+				packetPool.Put(buf)
 				log.Printf("4_database at=accept err=%q\n", err)
 				continue
 			}
-			s.wg.Add(1)
-			go func() {
-				s.handlePacket(packet[:n], addr)
-				s.wg.Done()
-			}()
+			packets <- packet{buf: buf, n: n, addr: addr}
 		}
 	}
 }
 
+func (s *Server) worker(packets <-chan packet) {
+	for p := range packets {
+		s.handlePacket(p.buf[:p.n], p.addr)
+		packetPool.Put(p.buf)
+	}
+}
+
+// handlePacket serves one request. packet is only valid until it returns.
 func (s *Server) handlePacket(packet []byte, addr net.Addr) {
 	log.Printf("4_database at=handle-packet.start remote-addr=%q\n", addr)
 
@@ -83,21 +272,38 @@ func (s *Server) handlePacket(packet []byte, addr net.Addr) {
 		parts := bytes.SplitN(packet, []byte{'='}, 2)
 		key, value := string(parts[0]), string(parts[1])
 
-		// ignore attempts to modify version
-		if key == "version" {
+		// ignore attempts to modify version or reserved keys
+		if key == "version" || s.extensions && isExtension(key) {
 			log.Printf("4_database at=handle-packet.finish action=write-blocked key=%q remote-addr=%q\n", key, addr)
 			return
 		}
 
 		s.dbLock.Lock()
 		s.db[key] = value
+		var ts Timestamp
+		if s.clock != nil {
+			ts = s.clock.Now()
+			s.stamps[key] = ts
+		} else {
+			// Any time recovered from disk is for the value being replaced
+			delete(s.stamps, key)
+		}
+		s.appendLog(key, value, ts)
 		s.dbLock.Unlock()
+
+		if s.clock != nil {
+			s.replicate(key, value, ts)
+		}
 		log.Printf("4_database at=handle-packet.finish action=write key=%q remote-addr=%q\n", key, addr)
 		return
 	}
 
 	// handle retrieve
 	key := string(packet)
+	if s.extensions && isExtension(key) {
+		s.handleExtension(key, addr)
+		return
+	}
 	s.dbLock.Lock()
 	value := s.db[key] // value can be empty string
 	s.dbLock.Unlock()
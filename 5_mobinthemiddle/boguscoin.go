@@ -0,0 +1,62 @@
+package mobinthemiddle
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// RewriteBoguscoin replaces every Boguscoin address in line with addr. An
+// address is a whole whitespace-delimited word of 26 to 35 alphanumeric
+// characters starting with 7. It runs in time linear in the line.
+func RewriteBoguscoin(line, addr string) string {
+	var b strings.Builder
+	last := 0
+	for i := 0; i < len(line); {
+		r, size := utf8.DecodeRuneInString(line[i:])
+		if unicode.IsSpace(r) {
+			i += size
+			continue
+		}
+
+		// Find the end of the word starting at i
+		j := i + size
+		for j < len(line) {
+			r, size := utf8.DecodeRuneInString(line[j:])
+			if unicode.IsSpace(r) {
+				break
+			}
+			j += size
+		}
+
+		if IsBoguscoin(line[i:j]) {
+			if b.Len() == 0 {
+				b.Grow(len(line))
+			}
+			b.WriteString(line[last:i])
+			b.WriteString(addr)
+			last = j
+		}
+		i = j
+	}
+
+	if last == 0 {
+		return line
+	}
+	b.WriteString(line[last:])
+	return b.String()
+}
+
+// IsBoguscoin reports whether word is a Boguscoin address
+func IsBoguscoin(word string) bool {
+	if len(word) < 26 || len(word) > 35 || word[0] != '7' {
+		return false
+	}
+	for i := 1; i < len(word); i++ {
+		c := word[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
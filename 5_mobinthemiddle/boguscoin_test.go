@@ -0,0 +1,116 @@
+package mobinthemiddle
+
+import (
+	"math/rand"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// The tokenizer is checked against regexps doing the same without the
+// lookaround the original pattern needed: find each word, as delimited by
+// the characters unicode.IsSpace reports, then match the whole word.
+var (
+	wordRegexp      = regexp.MustCompile(`[^\t\n\v\f\r\x{85}\pZ]+`)
+	boguscoinRegexp = regexp.MustCompile(`^7[a-zA-Z0-9]{25,34}$`)
+)
+
+func rewriteWithRegexp(line, addr string) string {
+	return wordRegexp.ReplaceAllStringFunc(line, func(word string) string {
+		if boguscoinRegexp.MatchString(word) {
+			return addr
+		}
+		return word
+	})
+}
+
+func TestRewriteBoguscoin(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"", ""},
+		{"no coins here", "no coins here"},
+		{"7F1u3wSD5RbOHQmupo9nx4TnhQ", "X"},
+		{"7F1u3wSD5RbOHQmupo9nx4Tnh", "7F1u3wSD5RbOHQmupo9nx4Tnh"},
+		{"7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T", "X"},
+		{"7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8TX", "7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8TX"},
+		{"8F1u3wSD5RbOHQmupo9nx4TnhQ", "8F1u3wSD5RbOHQmupo9nx4TnhQ"},
+		{"pay 7F1u3wSD5RbOHQmupo9nx4TnhQ-1234", "pay 7F1u3wSD5RbOHQmupo9nx4TnhQ-1234"},
+		{"  7F1u3wSD5RbOHQmupo9nx4TnhQ\t7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX  ", "  X\tX  "},
+		{"é7F1u3wSD5RbOHQmupo9nx4TnhQ", "é7F1u3wSD5RbOHQmupo9nx4TnhQ"},
+		{" 7F1u3wSD5RbOHQmupo9nx4TnhQ　", " X　"},
+	}
+	for _, tc := range tests {
+		if got := RewriteBoguscoin(tc.input, "X"); got != tc.want {
+			t.Errorf("RewriteBoguscoin(%q) = %q, want %q", tc.input, got, tc.want)
+		}
+		if got := rewriteWithRegexp(tc.input, "X"); got != tc.want {
+			t.Errorf("regexp disagrees on %q: %q", tc.input, got)
+		}
+	}
+}
+
+// randomLine builds lines dense in near-miss addresses and odd whitespace
+func randomLine(rng *rand.Rand) string {
+	pieces := []string{" ", "  ", "\t", "\r", " ", " ", "-", "é", "7", "a", "Z", "0"}
+	var b strings.Builder
+	for n := rng.Intn(6); n >= 0; n-- {
+		if rng.Intn(2) == 0 {
+			b.WriteString("7")
+			for i := 24 + rng.Intn(13); i > 0; i-- {
+				b.WriteByte("abcXYZ0189"[rng.Intn(10)])
+			}
+		}
+		b.WriteString(pieces[rng.Intn(len(pieces))])
+	}
+	return b.String()
+}
+
+func TestRewriteBoguscoinMatchesRegexp(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		line := randomLine(rng)
+		if got, want := RewriteBoguscoin(line, "X"), rewriteWithRegexp(line, "X"); got != want {
+			t.Fatalf("RewriteBoguscoin(%q) = %q, regexp gives %q", line, got, want)
+		}
+	}
+}
+
+func FuzzRewriteBoguscoin(f *testing.F) {
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 20; i++ {
+		f.Add(randomLine(rng))
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		if got, want := RewriteBoguscoin(line, "X"), rewriteWithRegexp(line, "X"); got != want {
+			t.Errorf("RewriteBoguscoin(%q) = %q, regexp gives %q", line, got, want)
+		}
+	})
+}
+
+func benchmarkLine() string {
+	words := []string{"hello", "7F1u3wSD5RbOHQmupo9nx4TnhQ", "7notquitelongenough", "world", "7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8TX"}
+	var b strings.Builder
+	for i := 0; b.Len() < 8<<10; i++ {
+		b.WriteString(words[i%len(words)])
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+func BenchmarkRewriteBoguscoin(b *testing.B) {
+	line := benchmarkLine()
+	b.SetBytes(int64(len(line)))
+	for i := 0; i < b.N; i++ {
+		RewriteBoguscoin(line, TonyAddress)
+	}
+}
+
+func BenchmarkRewriteBoguscoinRegexp(b *testing.B) {
+	line := benchmarkLine()
+	b.SetBytes(int64(len(line)))
+	for i := 0; i < b.N; i++ {
+		rewriteWithRegexp(line, TonyAddress)
+	}
+}
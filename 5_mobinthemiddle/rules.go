@@ -0,0 +1,138 @@
+package mobinthemiddle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/fanatic/protohackers/proxy"
+)
+
+// Direction is which way through the proxy a rule applies
+type Direction int
+
+const (
+	ClientToServer Direction = 1 << iota
+	ServerToClient
+	Both = ClientToServer | ServerToClient
+)
+
+func (d Direction) String() string {
+	switch d {
+	case ClientToServer:
+		return "client-to-server"
+	case ServerToClient:
+		return "server-to-client"
+	case Both:
+		return "both"
+	}
+	return fmt.Sprintf("Direction(%d)", int(d))
+}
+
+// direction converts the way a message is travelling through the proxy
+func direction(d proxy.Direction) Direction {
+	if d == proxy.ServerToClient {
+		return ServerToClient
+	}
+	return ClientToServer
+}
+
+func (d Direction) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Direction) UnmarshalText(b []byte) error {
+	switch string(b) {
+	case "client-to-server":
+		*d = ClientToServer
+	case "server-to-client":
+		*d = ServerToClient
+	case "both", "":
+		*d = Both
+	default:
+		return fmt.Errorf("unknown direction %q", b)
+	}
+	return nil
+}
+
+// Rule rewrites every match of Pattern in a line travelling in Direction.
+// A nil Pattern matches Boguscoin addresses.
+type Rule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+	Direction   Direction
+}
+
+type ruleConfig struct {
+	Pattern     string    `json:"pattern"`
+	Boguscoin   bool      `json:"boguscoin"`
+	Replacement string    `json:"replacement"`
+	Direction   Direction `json:"direction"`
+}
+
+// LoadRules reads an ordered list of rules from a JSON file of the form
+//
+//	[{"pattern": "...", "replacement": "...", "direction": "client-to-server"}]
+//
+// where pattern is an RE2 regular expression, or "boguscoin": true replaces
+// Boguscoin addresses instead, and direction is client-to-server,
+// server-to-client or both (the default). RE2 matches in time linear in the
+// line, so patterns using lookaround, which it can't, are rejected.
+func LoadRules(path string) ([]Rule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []ruleConfig
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	rules := make([]Rule, 0, len(configs))
+	for i, c := range configs {
+		r := Rule{Replacement: c.Replacement, Direction: c.Direction}
+		if r.Direction == 0 {
+			r.Direction = Both
+		}
+		if !c.Boguscoin {
+			if r.Pattern, err = compilePattern(c.Pattern); err != nil {
+				return nil, fmt.Errorf("%s: rule %d: %w", path, i, err)
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// compilePattern compiles an RE2 pattern, explaining why lookaround fails
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	var serr *syntax.Error
+	if errors.As(err, &serr) {
+		for _, op := range []string{"(?=", "(?!", "(?<=", "(?<!"} {
+			if strings.HasPrefix(serr.Expr, op) {
+				return nil, fmt.Errorf("lookaround %s is not supported: %w", op, err)
+			}
+		}
+	}
+	return re, err
+}
+
+// rewrite applies, in order, each rule for direction d to line
+func rewrite(rules []Rule, d Direction, line string) string {
+	for _, r := range rules {
+		if r.Direction&d == 0 {
+			continue
+		}
+		if r.Pattern == nil {
+			line = RewriteBoguscoin(line, r.Replacement)
+		} else {
+			line = r.Pattern.ReplaceAllString(line, r.Replacement)
+		}
+	}
+	return line
+}
@@ -0,0 +1,19 @@
+package mobinthemiddle
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompilePattern(t *testing.T) {
+	for _, pattern := range []string{`says(?= hi)`, `(?!x)y`, `(?<=my )cat`, `(?<!a)b`} {
+		if _, err := compilePattern(pattern); err == nil || !strings.Contains(err.Error(), "lookaround") {
+			t.Errorf("compilePattern(%q) = %v, want a lookaround error", pattern, err)
+		}
+	}
+	for _, pattern := range []string{`\bhi\b`, `(?P<word>\w+)`, `(?i)cat`} {
+		if _, err := compilePattern(pattern); err != nil {
+			t.Errorf("compilePattern(%q) = %v", pattern, err)
+		}
+	}
+}
@@ -1,29 +1,149 @@
 package mobinthemiddle
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"errors"
-	"io"
 	"log"
 	"net"
 	"sync"
+	"time"
 
-	"github.com/dlclark/regexp2"
+	"github.com/fanatic/protohackers/proxy"
 	proxyproto "github.com/pires/go-proxyproto"
 )
 
+const (
+	// DefaultUpstream is the real chat server we sit in front of
+	DefaultUpstream = "chat.protohackers.com:16963"
+
+	// TonyAddress is where Boguscoin payments are redirected by default
+	TonyAddress = "7YWHMfk9JZe0LM0g1ZauHuiSxhI"
+
+	defaultDialTimeout  = 5 * time.Second
+	defaultDialAttempts = 3
+	defaultDialBackoff  = 100 * time.Millisecond
+
+	// poolMaxIdle is how long a pooled upstream connection is trusted to
+	// still be open before it is discarded unused
+	poolMaxIdle = 30 * time.Second
+
+	// lingerTimeout is how long a client may stay connected after the
+	// upstream hangs up, and vice versa
+	lingerTimeout = 10 * time.Second
+)
+
 type Server struct {
 	Addr   string
 	l      net.Listener
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
 
-	Boguscoin *regexp2.Regexp
+	upstream string
+	rules    []Rule
+
+	dial          func(ctx context.Context, network, addr string) (net.Conn, error)
+	dialTimeout   time.Duration
+	dialAttempts  int
+	dialBackoff   time.Duration
+	upstreamError string
+	onSessionEnd  func(SessionStats)
+
+	poolSize  int
+	pool      chan pooledConn
+	poolSlots chan struct{} // holds a token for each pooled or dialling conn
 }
 
-func NewServer(ctx context.Context, port string) (*Server, error) {
+// pooledConn is an upstream connection dialled before a client asked for it
+type pooledConn struct {
+	net.Conn
+	dialed time.Time
+}
+
+type Option func(*Server)
+
+// WithUpstream proxies connections to addr instead of DefaultUpstream
+func WithUpstream(addr string) Option {
+	return func(s *Server) {
+		s.upstream = addr
+	}
+}
+
+// WithRules replaces the default Boguscoin rewrite with rules, applied in
+// order to every line
+func WithRules(rules ...Rule) Option {
+	return func(s *Server) {
+		s.rules = rules
+	}
+}
+
+// WithDialTimeout gives up on each attempt to reach the upstream after d
+func WithDialTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.dialTimeout = d
+	}
+}
+
+// WithDialRetry tries to reach the upstream up to attempts times, waiting
+// backoff after the first failure and doubling the wait after each one.
+// Values <= 0 keep the defaults.
+func WithDialRetry(attempts int, backoff time.Duration) Option {
+	return func(s *Server) {
+		if attempts > 0 {
+			s.dialAttempts = attempts
+		}
+		if backoff > 0 {
+			s.dialBackoff = backoff
+		}
+	}
+}
+
+// WithDialContext connects to the upstream with dial instead of a net.Dialer
+// honouring the dial timeout
+func WithDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) Option {
+	return func(s *Server) {
+		s.dial = dial
+	}
+}
+
+// WithUpstreamPool keeps up to n upstream connections dialled ahead of time,
+// so arriving clients don't wait on the dial
+func WithUpstreamPool(n int) Option {
+	return func(s *Server) {
+		s.poolSize = n
+	}
+}
+
+// WithUpstreamErrorMessage sends msg to clients before disconnecting them
+// when the upstream can't be reached
+func WithUpstreamErrorMessage(msg string) Option {
+	return func(s *Server) {
+		s.upstreamError = msg
+	}
+}
+
+// WithSessionStats calls f with the statistics of every finished session
+func WithSessionStats(f func(SessionStats)) Option {
+	return func(s *Server) {
+		s.onSessionEnd = f
+	}
+}
+
+func NewServer(ctx context.Context, port string, opts ...Option) (*Server, error) {
+	s := &Server{
+		upstream:     DefaultUpstream,
+		rules:        []Rule{{Replacement: TonyAddress, Direction: Both}},
+		dialTimeout:  defaultDialTimeout,
+		dialAttempts: defaultDialAttempts,
+		dialBackoff:  defaultDialBackoff,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.dial == nil {
+		d := net.Dialer{Timeout: s.dialTimeout}
+		s.dial = d.DialContext
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 
 	var lc net.ListenConfig
@@ -37,11 +157,18 @@ func NewServer(ctx context.Context, port string) (*Server, error) {
 	l = &proxyproto.Listener{Listener: l}
 
 	log.Printf("5_mobinthemiddle at=server.listening addr=%q\n", l.Addr().String())
-	s := &Server{
-		Addr:      l.Addr().String(),
-		l:         l,
-		cancel:    cancel,
-		Boguscoin: regexp2.MustCompile(`(?<=^|\s)(7[a-zA-Z0-9]{25,34})(?=\s|$)`, regexp2.None),
+	s.Addr = l.Addr().String()
+	s.l = l
+	s.cancel = cancel
+
+	if s.poolSize > 0 {
+		s.pool = make(chan pooledConn, s.poolSize)
+		s.poolSlots = make(chan struct{}, s.poolSize)
+		s.wg.Add(1)
+		go func() {
+			s.fillPool(ctx)
+			s.wg.Done()
+		}()
 	}
 
 	go s.acceptLoop(ctx)
@@ -58,6 +185,14 @@ func (s *Server) Close() error {
 
 	// Wait for all connections to gracefully close (allow systemd to sigkill us)
 	s.wg.Wait()
+
+	// Hang up on any pooled connections nobody used
+	if s.pool != nil {
+		close(s.pool)
+		for c := range s.pool {
+			c.Close()
+		}
+	}
 	return nil
 }
 
@@ -77,86 +212,135 @@ func (s *Server) acceptLoop(ctx context.Context) {
 			}
 			s.wg.Add(1)
 			go func() {
-				s.handleConn(conn)
+				s.handleConn(ctx, conn)
 				s.wg.Done()
 			}()
 		}
 	}
 }
 
-func (s *Server) handleConn(conn net.Conn) {
+func (s *Server) handleConn(ctx context.Context, conn net.Conn) {
 	defer conn.Close()
 	log.Printf("5_mobinthemiddle at=handle-connection.start remote-addr=%q\n", conn.RemoteAddr())
+	start := time.Now()
 
-	client, err := net.Dial("tcp", "chat.protohackers.com:16963")
+	client, err := s.takeUpstream(ctx)
 	if err != nil {
 		log.Printf("5_mobinthemiddle at=client.err remote-addr=%q err=%s\n", conn.RemoteAddr(), err)
+		if s.upstreamError != "" {
+			conn.SetWriteDeadline(time.Now().Add(s.dialTimeout))
+			conn.Write([]byte(s.upstreamError + "\n"))
+		}
 		return
 	}
 
-	wg := sync.WaitGroup{}
+	// Each direction is relayed by a single goroutine, so needs no lock
+	var rewritten [2]int64
+	rewriteRules := func(sess *proxy.Session, d proxy.Direction, msg []byte, next func([]byte) error) error {
+		out := rewrite(s.rules, direction(d), string(msg))
+		if out != string(msg) {
+			rewritten[d]++
+		}
+		return next([]byte(out))
+	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		s.oneWayCopy(conn, client)
-		client.Close()
-	}()
+	p := &proxy.Proxy{Framing: proxy.Lines, Middleware: []proxy.Middleware{rewriteRules}, Linger: lingerTimeout}
+	stats, err := p.Serve(conn, client)
+	if err != nil {
+		log.Printf("5_mobinthemiddle at=proxy.err remote-addr=%q err=%s\n", conn.RemoteAddr(), err)
+	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		s.oneWayCopy(client, conn)
-		client.Close()
-	}()
+	st := SessionStats{
+		RemoteAddr:    conn.RemoteAddr().String(),
+		Duration:      time.Since(start),
+		LinesUp:       stats.Messages[proxy.ClientToServer],
+		LinesDown:     stats.Messages[proxy.ServerToClient],
+		BytesUp:       stats.Bytes[proxy.ClientToServer],
+		BytesDown:     stats.Bytes[proxy.ServerToClient],
+		RewrittenUp:   rewritten[proxy.ClientToServer],
+		RewrittenDown: rewritten[proxy.ServerToClient],
+	}
+	log.Printf("5_mobinthemiddle at=handle-connection.finish remote-addr=%q duration=%s lines-up=%d lines-down=%d bytes-up=%d bytes-down=%d rewritten-up=%d rewritten-down=%d\n",
+		st.RemoteAddr, st.Duration, st.LinesUp, st.LinesDown, st.BytesUp, st.BytesDown, st.RewrittenUp, st.RewrittenDown)
+	if s.onSessionEnd != nil {
+		s.onSessionEnd(st)
+	}
+}
 
-	wg.Wait()
+// SessionStats describes a finished session. Up is from the client to the
+// upstream and down is back again.
+type SessionStats struct {
+	RemoteAddr string
+	Duration   time.Duration
 
-	log.Printf("5_mobinthemiddle at=handle-connection.finish remote-addr=%q\n", conn.RemoteAddr())
+	LinesUp, LinesDown         int64
+	BytesUp, BytesDown         int64
+	RewrittenUp, RewrittenDown int64
 }
 
-func (s *Server) oneWayCopy(in io.Reader, out io.Writer) {
-	scanner := bufio.NewScanner(in)
-	scanner.Split(ScanTerminatedLines)
-	// optionally, resize scanner's capacity for lines over 64K, see next example
-	for scanner.Scan() {
-		t := scanner.Text()
-		//log.Printf("5_mobinthemiddle at=copy msg=%q\n", t)
+// takeUpstream hands out a fresh pooled upstream connection, or dials one
+// when the pool is empty
+func (s *Server) takeUpstream(ctx context.Context) (net.Conn, error) {
+	for {
+		select {
+		case c := <-s.pool:
+			<-s.poolSlots
+			if time.Since(c.dialed) < poolMaxIdle {
+				return c.Conn, nil
+			}
+			c.Close()
+		default:
+			return s.dialUpstream(ctx)
+		}
+	}
+}
 
-		b, _ := s.Boguscoin.Replace(t, "7YWHMfk9JZe0LM0g1ZauHuiSxhI", -1, -1)
-		_, err := out.Write([]byte(b + "\n"))
-		if errors.Is(err, net.ErrClosed) {
-			return
-		} else if err != nil {
-			log.Printf("5_mobinthemiddle at=write.err err=%s\n", err)
+// fillPool keeps the pool topped up with upstream connections until ctx is
+// done, backing off while the upstream can't be reached
+func (s *Server) fillPool(ctx context.Context) {
+	for {
+		select {
+		case s.poolSlots <- struct{}{}:
+		case <-ctx.Done():
 			return
 		}
-	}
 
-	err := scanner.Err()
-	if errors.Is(err, net.ErrClosed) {
-		return
-	} else if err != nil {
-		log.Printf("5_mobinthemiddle at=scan.err err=%s\n", err)
-		return
+		c, err := s.dialUpstream(ctx)
+		if err != nil {
+			log.Printf("5_mobinthemiddle at=pool.err err=%s\n", err)
+			<-s.poolSlots
+			select {
+			case <-time.After(s.dialBackoff):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		s.pool <- pooledConn{Conn: c, dialed: time.Now()}
 	}
 }
 
-func ScanTerminatedLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	if atEOF {
-		return 0, nil, nil
-	}
-	if i := bytes.IndexByte(data, '\n'); i >= 0 {
-		// We have a full newline-terminated line.
-		return i + 1, dropCR(data[0:i]), nil
+// dialUpstream connects to the upstream, retrying with exponential backoff
+func (s *Server) dialUpstream(ctx context.Context) (net.Conn, error) {
+	backoff := s.dialBackoff
+	for attempt := 1; ; attempt++ {
+		c, err := s.dial(ctx, "tcp", s.upstream)
+		if err == nil || attempt >= s.dialAttempts {
+			return c, err
+		}
+		log.Printf("5_mobinthemiddle at=client.retry attempt=%d backoff=%s err=%s\n", attempt, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
 	}
-	// Request more data.
-	return 0, nil, nil
 }
 
-func dropCR(data []byte) []byte {
-	if len(data) > 0 && data[len(data)-1] == '\r' {
-		return data[0 : len(data)-1]
-	}
-	return data
+// ScanTerminatedLines is a bufio.SplitFunc yielding newline-terminated lines
+// without their line endings, dropping any unterminated remainder
+func ScanTerminatedLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	return proxy.Lines.Split(data, atEOF)
 }
@@ -0,0 +1,19 @@
+package mobinthemiddle
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestScanTerminatedLines(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("one\r\ntwo\nthree"))
+	scanner.Split(ScanTerminatedLines)
+	var got []string
+	for scanner.Scan() {
+		got = append(got, scanner.Text())
+	}
+	if want := []string{"one", "two"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got lines %q, want %q", got, want)
+	}
+}
@@ -15,9 +15,13 @@ func main() {
 	if port == "" {
 		port = "10010"
 	}
+	var opts []budgetchat.Option
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		opts = append(opts, budgetchat.WithDataDir(dir))
+	}
 	ctx := context.Background()
 
-	s, err := budgetchat.NewServer(ctx, port)
+	s, err := budgetchat.NewServer(ctx, port, opts...)
 	if err != nil {
 		log.Fatalf("10_voraciouscodestorage at=server err=%q\n", err)
 	}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	voraciouscodestorage "github.com/fanatic/protohackers/10_voraciouscodestorage"
+)
+
+// Exports the files stored by 10_voraciouscodestorage in DATA_DIR as a git
+// fast-import stream on stdout:
+//
+//	DATA_DIR=/data 10_voraciouscodestorage_export | git -C repo fast-import
+func main() {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		log.Fatalf("10_voraciouscodestorage_export at=export err=\"DATA_DIR is required\"\n")
+	}
+
+	if err := voraciouscodestorage.ExportGitDataDir(os.Stdout, dir); err != nil {
+		log.Fatalf("10_voraciouscodestorage_export at=export err=%q\n", err)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 
 	budgetchat "github.com/fanatic/protohackers/3_budgetchat"
@@ -15,9 +17,32 @@ func main() {
 	if port == "" {
 		port = "10003"
 	}
+	var opts []budgetchat.Option
+	if n, err := strconv.Atoi(os.Getenv("HISTORY_SIZE")); err == nil {
+		opts = append(opts, budgetchat.WithHistory(n))
+	}
+	if dir := os.Getenv("TRANSCRIPT_DIR"); dir != "" {
+		opts = append(opts, budgetchat.WithTranscriptDir(dir))
+	}
+	if n, err := strconv.Atoi(os.Getenv("MAX_MESSAGE_LENGTH")); err == nil {
+		opts = append(opts, budgetchat.WithMaxMessageLength(n))
+	}
+	if rate, err := strconv.ParseFloat(os.Getenv("RATE_LIMIT"), 64); err == nil {
+		burst, _ := strconv.Atoi(os.Getenv("RATE_BURST"))
+		opts = append(opts, budgetchat.WithRateLimit(rate, burst))
+	}
+	if words := os.Getenv("BANNED_WORDS"); words != "" {
+		opts = append(opts, budgetchat.WithModerator(budgetchat.NewWordFilter(strings.Split(words, ",")...)))
+	}
+	if password := os.Getenv("OPERATOR_PASSWORD"); password != "" {
+		opts = append(opts, budgetchat.WithOperatorPassword(password))
+	}
+	if wsPort := os.Getenv("WS_PORT"); wsPort != "" {
+		opts = append(opts, budgetchat.WithWebSocket("0.0.0.0:"+wsPort))
+	}
 	ctx := context.Background()
 
-	s, err := budgetchat.NewServer(ctx, port)
+	s, err := budgetchat.NewServer(ctx, port, opts...)
 	if err != nil {
 		log.Fatalf("3_budgetchat at=server err=%q\n", err)
 	}
@@ -5,7 +5,10 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	database "github.com/fanatic/protohackers/4_database"
 )
@@ -15,9 +18,29 @@ func main() {
 	if addr == "" {
 		addr = "fly-global-services:10004"
 	}
+	var opts []database.Option
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		opts = append(opts, database.WithDataDir(dir))
+	}
+	if d, err := time.ParseDuration(os.Getenv("SNAPSHOT_INTERVAL")); err == nil {
+		opts = append(opts, database.WithSnapshotInterval(d))
+	}
+	if n, err := strconv.Atoi(os.Getenv("WORKERS")); err == nil {
+		opts = append(opts, database.WithWorkers(n))
+	}
+	if os.Getenv("EXTENSIONS") != "" {
+		opts = append(opts, database.WithExtensions())
+	}
+	if peerAddr := os.Getenv("PEER_ADDR"); peerAddr != "" {
+		var peers []string
+		if p := os.Getenv("PEERS"); p != "" {
+			peers = strings.Split(p, ",")
+		}
+		opts = append(opts, database.WithReplication(peerAddr, peers...))
+	}
 	ctx := context.Background()
 
-	s, err := database.NewServer(ctx, addr)
+	s, err := database.NewServer(ctx, addr, opts...)
 	if err != nil {
 		log.Fatalf("4_database at=server err=%q\n", err)
 	}
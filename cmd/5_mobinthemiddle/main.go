@@ -5,7 +5,9 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
 	budgetchat "github.com/fanatic/protohackers/5_mobinthemiddle"
 )
@@ -15,9 +17,32 @@ func main() {
 	if port == "" {
 		port = "10005"
 	}
+	var opts []budgetchat.Option
+	if upstream := os.Getenv("UPSTREAM"); upstream != "" {
+		opts = append(opts, budgetchat.WithUpstream(upstream))
+	}
+	if d, err := time.ParseDuration(os.Getenv("DIAL_TIMEOUT")); err == nil {
+		opts = append(opts, budgetchat.WithDialTimeout(d))
+	}
+	attempts, _ := strconv.Atoi(os.Getenv("DIAL_ATTEMPTS"))
+	backoff, _ := time.ParseDuration(os.Getenv("DIAL_BACKOFF"))
+	opts = append(opts, budgetchat.WithDialRetry(attempts, backoff))
+	if n, err := strconv.Atoi(os.Getenv("UPSTREAM_POOL")); err == nil && n > 0 {
+		opts = append(opts, budgetchat.WithUpstreamPool(n))
+	}
+	if msg := os.Getenv("UPSTREAM_ERROR_MESSAGE"); msg != "" {
+		opts = append(opts, budgetchat.WithUpstreamErrorMessage(msg))
+	}
+	if path := os.Getenv("RULES_FILE"); path != "" {
+		rules, err := budgetchat.LoadRules(path)
+		if err != nil {
+			log.Fatalf("5_mobinthemiddle at=rules err=%q\n", err)
+		}
+		opts = append(opts, budgetchat.WithRules(rules...))
+	}
 	ctx := context.Background()
 
-	s, err := budgetchat.NewServer(ctx, port)
+	s, err := budgetchat.NewServer(ctx, port, opts...)
 	if err != nil {
 		log.Fatalf("5_mobinthemiddle at=server err=%q\n", err)
 	}
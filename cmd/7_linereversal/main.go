@@ -5,9 +5,11 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 
 	linereversal "github.com/fanatic/protohackers/7_linereversal"
+	"github.com/fanatic/protohackers/lrcp"
 )
 
 func main() {
@@ -15,9 +17,16 @@ func main() {
 	if addr == "" {
 		addr = "fly-global-services:10007"
 	}
+	var opts []linereversal.Option
+	if n, err := strconv.Atoi(os.Getenv("RECEIVE_WINDOW")); err == nil && n > 0 {
+		opts = append(opts, linereversal.WithLRCPOptions(lrcp.WithReceiveWindow(n)))
+	}
+	if n, err := strconv.Atoi(os.Getenv("SEND_WINDOW")); err == nil && n > 0 {
+		opts = append(opts, linereversal.WithLRCPOptions(lrcp.WithSendWindow(n)))
+	}
 	ctx := context.Background()
 
-	s, err := linereversal.NewServer(ctx, addr)
+	s, err := linereversal.NewServer(ctx, addr, opts...)
 	if err != nil {
 		log.Fatalf("7_linereversal at=server err=%q\n", err)
 	}
@@ -0,0 +1,277 @@
+// Package lrcp implements the Line Reversal Control Protocol, a reliable
+// byte stream carried over UDP. Sessions implement net.Conn, so any
+// stream-based application can run over it.
+package lrcp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Listener accepts LRCP sessions arriving on a packet connection. Dialed
+// sessions get a Listener of their own that accepts nothing.
+type Listener struct {
+	conn      net.PacketConn
+	accept    chan *Session // nil when not accepting
+	done      chan struct{}
+	closeOnce sync.Once
+
+	sessionTimeout time.Duration
+	receiveWindow  int
+	sendWindow     int
+
+	SessionLock sync.Mutex
+	Sessions    map[int]*Session
+}
+
+type Option func(*Listener)
+
+// WithSessionTimeout sets how long a session may go without hearing from
+// its peer, or with sent data unacknowledged, before it expires
+func WithSessionTimeout(d time.Duration) Option {
+	return func(l *Listener) {
+		l.sessionTimeout = d
+	}
+}
+
+// WithReceiveWindow sets how much data a session holds for the app to
+// read. Data beyond it is not acknowledged, so the peer holds on to it.
+// Windows of less than a byte are ignored.
+func WithReceiveWindow(n int) Option {
+	return func(l *Listener) {
+		if n > 0 {
+			l.receiveWindow = n
+		}
+	}
+}
+
+// WithSendWindow sets how much data a session may have sent without it
+// being acknowledged before writes block. Windows of less than a byte are
+// ignored.
+func WithSendWindow(n int) Option {
+	return func(l *Listener) {
+		if n > 0 {
+			l.sendWindow = n
+		}
+	}
+}
+
+// Listen announces on the local UDP address
+func Listen(addr string, opts ...Option) (net.Listener, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(conn, opts...), nil
+}
+
+// NewListener accepts sessions on conn, which it takes ownership of
+func NewListener(conn net.PacketConn, opts ...Option) *Listener {
+	l := newListener(conn, opts)
+	l.accept = make(chan *Session)
+	go l.readLoop()
+	return l
+}
+
+func newListener(conn net.PacketConn, opts []Option) *Listener {
+	l := &Listener{
+		conn:           conn,
+		done:           make(chan struct{}),
+		sessionTimeout: defaultSessionTimeout,
+		receiveWindow:  defaultWindow,
+		sendWindow:     defaultWindow,
+		Sessions:       map[int]*Session{},
+	}
+	for _, o := range opts {
+		o(l)
+	}
+	return l
+}
+
+// Dial opens a session to the LRCP server at addr
+func Dial(addr string, opts ...Option) (net.Conn, error) {
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	return DialPacket(conn, addr, opts...)
+}
+
+// DialPacket opens a session to the LRCP server at addr over conn, which
+// it takes ownership of
+func DialPacket(conn net.PacketConn, addr string, opts ...Option) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	l := newListener(conn, opts)
+	id := rand.New(rand.NewSource(time.Now().UnixNano())).Intn(maxNumber)
+	sess := newSession(l, id, raddr)
+	sess.dialed = true
+	l.Sessions[id] = sess
+	go l.readLoop()
+
+	// Keep asking until the server acks, backing off, or give up on it
+	expire := time.NewTimer(l.sessionTimeout)
+	defer expire.Stop()
+	for rto := initialRTO; ; {
+		l.reply(fmt.Sprintf("/connect/%d/", id), raddr)
+		select {
+		case <-sess.connected:
+			go sess.Retrier()
+			return sess, nil
+		case <-time.After(rto):
+		case <-expire.C:
+			sess.finish(ErrSessionExpired)
+			return nil, fmt.Errorf("lrcp: dial %s: no response", addr)
+		}
+		if rto *= 2; rto > maxRTO {
+			rto = maxRTO
+		}
+	}
+}
+
+// Accept waits for and returns the next session
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case sess := <-l.accept:
+		return sess, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops listening, closing every session
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+
+		l.SessionLock.Lock()
+		sessions := make([]*Session, 0, len(l.Sessions))
+		for _, sess := range l.Sessions {
+			sessions = append(sessions, sess)
+		}
+		l.SessionLock.Unlock()
+
+		for _, sess := range sessions {
+			sess.Close()
+		}
+		l.conn.Close()
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func (l *Listener) readLoop() {
+	packet := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := l.conn.ReadFrom(packet)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("lrcp at=read err=%q\n", err)
+			continue
+		}
+		l.handlePacket(packet[:n], addr)
+	}
+}
+
+func (l *Listener) handlePacket(packet []byte, addr net.Addr) {
+	log.Printf("lrcp <-- %q %s\n", packet, addr)
+
+	if len(packet) >= maxPacketSize {
+		log.Printf("lrcp at=handle-packet.err remote-addr=%q too-long\n", addr)
+		return
+	}
+	msg, err := parseMessage(packet)
+	if err != nil {
+		log.Printf("lrcp at=handle-packet.err remote-addr=%q %s\n", addr, err)
+		return
+	}
+
+	if msg.Type == "connect" {
+		l.handleConnect(msg.Session, addr)
+		return
+	}
+
+	l.SessionLock.Lock()
+	sess, exists := l.Sessions[msg.Session]
+	l.SessionLock.Unlock()
+	if !exists {
+		// If the session is not open: send /close/SESSION/ and stop.
+		log.Printf("lrcp at=handle-packet.err type=%s session=%d session-missing\n", msg.Type, msg.Session)
+		l.reply(fmt.Sprintf("/close/%d/", msg.Session), addr)
+		return
+	}
+	sess.touch()
+
+	switch msg.Type {
+	case "data":
+		sess.handleData(msg.Pos, msg.Data)
+	case "ack":
+		sess.handleAck(msg.Pos)
+	case "close":
+		l.reply(fmt.Sprintf("/close/%d/", msg.Session), addr)
+		sess.finish(io.EOF)
+	}
+}
+
+func (l *Listener) handleConnect(session int, remote net.Addr) {
+	if l.accept == nil {
+		log.Printf("lrcp at=connect.err session=%d not-listening\n", session)
+		return
+	}
+
+	l.SessionLock.Lock()
+	sess, exists := l.Sessions[session]
+	if !exists {
+		// If no session with this token is open: open one, and associate it
+		// with the IP address and port number that the UDP packet originated from.
+		sess = newSession(l, session, remote)
+		close(sess.connected)
+		l.Sessions[session] = sess
+	} else {
+		sess.touch()
+	}
+	l.SessionLock.Unlock()
+
+	l.reply(fmt.Sprintf("/ack/%d/0/", session), remote)
+
+	if !exists {
+		go sess.Retrier()
+		// Don't hold up other sessions' packets waiting to be accepted
+		go func() {
+			select {
+			case l.accept <- sess:
+			case <-l.done:
+				sess.Close()
+			}
+		}()
+	}
+}
+
+// reply sends one datagram, dropping it if it's too long to be valid
+func (l *Listener) reply(response string, addr net.Addr) {
+	if len(response) >= maxPacketSize {
+		log.Printf("lrcp at=reply.err remote-addr=%q too-long\n", addr.String())
+		return
+	}
+	_, err := l.conn.WriteTo([]byte(response), addr)
+	if err != nil {
+		log.Printf("lrcp at=reply.err remote-addr=%q err=%s\n", addr.String(), err)
+		return
+	}
+	log.Printf("lrcp --> %q\n", response)
+}
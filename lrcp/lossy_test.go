@@ -0,0 +1,224 @@
+package lrcp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fanatic/protohackers/lrcp/lrcptest"
+)
+
+func lossyConn(t *testing.T, cfg lrcptest.Config) *lrcptest.LossyConn {
+	t.Helper()
+	conn, err := lrcptest.Listen(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestLossyEcho(t *testing.T) {
+	l := NewListener(lossyConn(t, lrcptest.Config{Seed: 1, Loss: 0.25}))
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				r := bufio.NewReader(c)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						break
+					}
+					c.Write([]byte(line))
+				}
+				c.Close()
+			}()
+		}
+	}()
+
+	conn, err := DialPacket(lossyConn(t, lrcptest.Config{Seed: 2, Loss: 0.25}), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+
+	r := bufio.NewReader(conn)
+	for i := 0; i < 10; i++ {
+		want := fmt.Sprintf("line %d %s\n", i, strings.Repeat("a/b\\", i*50))
+		if _, err := conn.Write([]byte(want)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		if got != want {
+			t.Fatalf("line %d: got %q, want %q", i, got, want)
+		}
+	}
+
+	// Loopback round trips are quick, so the timeout should follow them
+	// down, whatever backing off it is doing at the moment
+	sess := conn.(*Session)
+	sess.OutLock.Lock()
+	srtt, rttvar := sess.srtt, sess.rttvar
+	sess.OutLock.Unlock()
+	if srtt == 0 || srtt+4*rttvar >= initialRTO {
+		t.Errorf("smoothed round trip time is %s, want it measured well below %s", srtt, initialRTO)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	l := NewListener(lossyConn(t, lrcptest.Config{}), WithSessionTimeout(300*time.Millisecond))
+	defer l.Close()
+
+	// A peer that connects and sends a line, then never acks the reply
+	peer, err := net.Dial("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peer.Write([]byte("/connect/7/"))
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.Write([]byte("/data/7/0/hello\n/"))
+	r := bufio.NewReader(c)
+	if _, err := r.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("olleh\n"))
+
+	start := time.Now()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.ReadString('\n'); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("got %v, want ErrSessionExpired", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expired after %s", elapsed)
+	}
+	if _, err := c.Write([]byte("x\n")); !errors.Is(err, ErrSessionExpired) {
+		t.Errorf("write after expiry: got %v, want ErrSessionExpired", err)
+	}
+
+	l.SessionLock.Lock()
+	n := len(l.Sessions)
+	l.SessionLock.Unlock()
+	if n != 0 {
+		t.Errorf("%d sessions left after expiry", n)
+	}
+
+	// The peer is told, in case it's still there
+	buf := make([]byte, maxPacketSize)
+	for {
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := peer.Read(buf)
+		if err != nil {
+			t.Fatalf("waiting for close: %v", err)
+		}
+		if string(buf[:n]) == "/close/7/" {
+			break
+		}
+	}
+}
+
+func TestIdleSessionExpires(t *testing.T) {
+	timeout := 300 * time.Millisecond
+	l := NewListener(lossyConn(t, lrcptest.Config{}), WithSessionTimeout(timeout))
+	defer l.Close()
+
+	// A peer that connects and vanishes, with nothing owed either way
+	peer, err := net.Dial("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peer.Write([]byte("/connect/7/"))
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("got %v, want ErrSessionExpired", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expired after %s", elapsed)
+	}
+
+	l.SessionLock.Lock()
+	n := len(l.Sessions)
+	l.SessionLock.Unlock()
+	if n != 0 {
+		t.Errorf("%d sessions left after expiry", n)
+	}
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := peer.Read(buf)
+		if err != nil {
+			t.Fatalf("waiting for close: %v", err)
+		}
+		if string(buf[:n]) == "/close/7/" {
+			break
+		}
+	}
+}
+
+func TestActiveSessionStaysOpen(t *testing.T) {
+	timeout := 300 * time.Millisecond
+	l := NewListener(lossyConn(t, lrcptest.Config{}), WithSessionTimeout(timeout))
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		r := bufio.NewReader(c)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			c.Write([]byte(line))
+		}
+	}()
+
+	conn, err := DialPacket(lossyConn(t, lrcptest.Config{}), l.Addr().String(), WithSessionTimeout(timeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	r := bufio.NewReader(conn)
+	for start := time.Now(); time.Since(start) < 4*timeout; time.Sleep(timeout / 6) {
+		if _, err := conn.Write([]byte("ping\n")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l.SessionLock.Lock()
+	n := len(l.Sessions)
+	l.SessionLock.Unlock()
+	if n != 1 {
+		t.Errorf("got %d sessions, want the active one", n)
+	}
+}
@@ -0,0 +1,139 @@
+package lrcp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// echo starts an LRCP echo server, returning its address
+func echo(t *testing.T) string {
+	t.Helper()
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestEcho(t *testing.T) {
+	conn, err := Dial(echo(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	want := []byte("foo/bar\\baz\n//\\\\\n")
+	if _, err := conn.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	conn, err := Dial(echo(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want os.ErrDeadlineExceeded", err)
+	}
+}
+
+func TestCloseByPeer(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Write([]byte("bye\n")); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "bye\n" {
+		t.Errorf("got %q, want %q", got, "bye\n")
+	}
+	if _, err := conn.Write([]byte("hello\n")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write after close: got %v, want net.ErrClosed", err)
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		packet string
+		want   message
+		ok     bool
+	}{
+		{"/connect/1234/", message{Type: "connect", Session: 1234}, true},
+		{"/data/1/5/a\\/b\\\\c/", message{Type: "data", Session: 1, Pos: 5, Data: []byte("a/b\\c")}, true},
+		{"/data/1/0//", message{Type: "data", Session: 1, Data: []byte{}}, true},
+		{"/ack/1/6/", message{Type: "ack", Session: 1, Pos: 6}, true},
+		{"/close/1/", message{Type: "close", Session: 1}, true},
+		{"/data/1/0/a/b/", message{}, false},
+		{"/data/1/0/a\\b/", message{}, false},
+		{"/ack/1/6/7/", message{}, false},
+		{"/connect/2147483648/", message{}, false},
+		{"/connect/-1/", message{}, false},
+		{"/connect/+1/", message{}, false},
+		{"/close/1", message{}, false},
+		{"close/1/", message{}, false},
+		{"/bogus/1/", message{}, false},
+	}
+	for _, tc := range tests {
+		got, err := parseMessage([]byte(tc.packet))
+		if (err == nil) != tc.ok {
+			t.Errorf("parseMessage(%q) err = %v", tc.packet, err)
+			continue
+		}
+		if tc.ok && (got.Type != tc.want.Type || got.Session != tc.want.Session || got.Pos != tc.want.Pos || !bytes.Equal(got.Data, tc.want.Data)) {
+			t.Errorf("parseMessage(%q) = %+v, want %+v", tc.packet, got, tc.want)
+		}
+	}
+}
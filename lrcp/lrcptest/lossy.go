@@ -0,0 +1,136 @@
+// Package lrcptest simulates an unreliable network in-process, so LRCP's
+// retransmission and reordering paths can be exercised over loopback.
+package lrcptest
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxHold is the longest a datagram is held back waiting for another to
+// overtake it
+const maxHold = 50 * time.Millisecond
+
+// Config describes how a LossyConn mistreats the datagrams written to it.
+// Chances are between 0 and 1.
+type Config struct {
+	// Seed seeds the random choices, so a scenario can be replayed
+	Seed int64
+
+	// Loss is the chance a datagram is silently dropped
+	Loss float64
+
+	// Duplicate is the chance a datagram is sent twice
+	Duplicate float64
+
+	// Reorder is the chance a datagram is held back until the next one
+	// has been sent
+	Reorder float64
+
+	// Delay is the most latency added to each datagram, chosen at random
+	Delay time.Duration
+}
+
+// Stats counts what a LossyConn did to the datagrams written to it
+type Stats struct {
+	Written    int
+	Dropped    int
+	Duplicated int
+	Reordered  int
+}
+
+// LossyConn is a net.PacketConn that mistreats outgoing datagrams.
+// Wrapping both ends of a conversation makes both directions unreliable.
+type LossyConn struct {
+	net.PacketConn
+	cfg Config
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	held  *datagram
+	stats Stats
+}
+
+type datagram struct {
+	b    []byte
+	addr net.Addr
+}
+
+func Wrap(conn net.PacketConn, cfg Config) *LossyConn {
+	return &LossyConn{PacketConn: conn, cfg: cfg, rng: rand.New(rand.NewSource(cfg.Seed))}
+}
+
+// Listen wraps a new UDP socket on the loopback interface
+func Listen(cfg Config) (*LossyConn, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	return Wrap(conn, cfg), nil
+}
+
+func (c *LossyConn) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// WriteTo always reports success, whatever happens to p
+func (c *LossyConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.Written++
+	if c.rng.Float64() < c.cfg.Loss {
+		c.stats.Dropped++
+		return len(p), nil
+	}
+	d := datagram{append([]byte(nil), p...), addr}
+	c.send(d)
+	if c.rng.Float64() < c.cfg.Duplicate {
+		c.stats.Duplicated++
+		c.send(d)
+	}
+	return len(p), nil
+}
+
+// send passes d on, maybe holding it back to be overtaken. The caller must
+// hold mu.
+func (c *LossyConn) send(d datagram) {
+	if c.held == nil && c.rng.Float64() < c.cfg.Reorder {
+		c.stats.Reordered++
+		held := &d
+		c.held = held
+		time.AfterFunc(maxHold, func() {
+			// Nothing overtook it in time
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.held == held {
+				c.held = nil
+				c.deliver(d)
+			}
+		})
+		return
+	}
+
+	c.deliver(d)
+	if c.held != nil {
+		held := *c.held
+		c.held = nil
+		c.deliver(held)
+	}
+}
+
+// deliver writes d after any delay. The caller must hold mu.
+func (c *LossyConn) deliver(d datagram) {
+	if c.cfg.Delay <= 0 {
+		c.PacketConn.WriteTo(d.b, d.addr)
+		return
+	}
+	delay := time.Duration(c.rng.Int63n(int64(c.cfg.Delay)))
+	time.AfterFunc(delay, func() {
+		c.PacketConn.WriteTo(d.b, d.addr)
+	})
+}
@@ -0,0 +1,82 @@
+package lrcptest
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// deliveries writes n numbered datagrams through cfg and returns the ones
+// that arrived, in the order they did
+func deliveries(t *testing.T, cfg Config, n int) ([]string, Stats) {
+	t.Helper()
+	dst, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	src, err := Listen(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	for i := 0; i < n; i++ {
+		src.WriteTo([]byte(fmt.Sprint(i)), dst.LocalAddr())
+	}
+
+	var got []string
+	buf := make([]byte, 100)
+	for {
+		dst.SetReadDeadline(time.Now().Add(cfg.Delay + 2*maxHold))
+		n, _, err := dst.ReadFrom(buf)
+		if err != nil {
+			return got, src.Stats()
+		}
+		got = append(got, string(buf[:n]))
+	}
+}
+
+func TestLossyConn(t *testing.T) {
+	t.Run("clean", func(t *testing.T) {
+		got, _ := deliveries(t, Config{}, 10)
+		if fmt.Sprint(got) != "[0 1 2 3 4 5 6 7 8 9]" {
+			t.Errorf("got %v", got)
+		}
+	})
+
+	t.Run("loss", func(t *testing.T) {
+		got, stats := deliveries(t, Config{Seed: 1, Loss: 0.25}, 100)
+		if len(got) != 100-stats.Dropped || stats.Dropped < 10 || stats.Dropped > 40 {
+			t.Errorf("got %d datagrams with %d dropped", len(got), stats.Dropped)
+		}
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		got, _ := deliveries(t, Config{Duplicate: 1}, 3)
+		if fmt.Sprint(got) != "[0 0 1 1 2 2]" {
+			t.Errorf("got %v", got)
+		}
+	})
+
+	t.Run("reorder", func(t *testing.T) {
+		got, stats := deliveries(t, Config{Seed: 1, Reorder: 0.5}, 20)
+		inOrder := true
+		for i := range got {
+			inOrder = inOrder && got[i] == fmt.Sprint(i)
+		}
+		if len(got) != 20 || stats.Reordered == 0 || inOrder {
+			t.Errorf("got %v with %d reordered", got, stats.Reordered)
+		}
+	})
+
+	t.Run("seeded", func(t *testing.T) {
+		cfg := Config{Seed: 7, Loss: 0.3, Duplicate: 0.3}
+		a, _ := deliveries(t, cfg, 50)
+		b, _ := deliveries(t, cfg, 50)
+		if fmt.Sprint(a) != fmt.Sprint(b) {
+			t.Errorf("same seed, different deliveries:\n%v\n%v", a, b)
+		}
+	})
+}
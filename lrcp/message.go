@@ -0,0 +1,115 @@
+package lrcp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// maxPacketSize is the size every LRCP datagram must stay under
+const maxPacketSize = 1000
+
+// maxNumber bounds every numeric field
+const maxNumber = 1 << 31
+
+// message is one parsed LRCP datagram
+type message struct {
+	Type    string
+	Session int
+	Pos     int    // of data, or the length of an ack
+	Data    []byte // unescaped
+}
+
+// parseMessage validates and parses a datagram. Any error means the
+// datagram should be silently ignored.
+func parseMessage(packet []byte) (message, error) {
+	// Packet contents must begin with a forward slash, end with a forward slash,
+	// have a valid message type, and have the correct number of fields for the message type.
+	if len(packet) < 2 {
+		return message{}, errors.New("too-small")
+	} else if packet[0] != '/' {
+		return message{}, errors.New("missing-begin")
+	} else if packet[len(packet)-1] != '/' {
+		return message{}, errors.New("missing-end")
+	}
+	packet = packet[1 : len(packet)-1]
+
+	// DATA may contain escaped slashes, so split off at most the fields before it
+	parts := bytes.SplitN(packet, []byte{'/'}, 4)
+
+	var msg message
+	msg.Type = string(parts[0])
+	fields := map[string]int{"connect": 2, "data": 4, "ack": 3, "close": 2}[msg.Type]
+	if fields == 0 {
+		return message{}, fmt.Errorf("unknown-type type=%q", msg.Type)
+	}
+	if len(parts) != fields {
+		return message{}, fmt.Errorf("fields type=%s", msg.Type)
+	}
+
+	var err error
+	if msg.Session, err = parseNumber(parts[1]); err != nil {
+		return message{}, err
+	}
+	if msg.Type == "data" || msg.Type == "ack" {
+		if msg.Pos, err = parseNumber(parts[2]); err != nil {
+			return message{}, err
+		}
+	}
+	if msg.Type == "data" {
+		if msg.Data, err = unescape(parts[3]); err != nil {
+			return message{}, err
+		}
+	}
+	return msg, nil
+}
+
+func parseNumber(b []byte) (int, error) {
+	if len(b) == 0 || b[0] < '0' || b[0] > '9' {
+		return 0, fmt.Errorf("bad-number value=%q", b)
+	}
+	n, err := strconv.Atoi(string(b))
+	if err != nil || n >= maxNumber {
+		return 0, fmt.Errorf("bad-number value=%q", b)
+	}
+	return n, nil
+}
+
+// escape backslashes and forward slashes in data
+func escape(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte{'\\'}, []byte{'\\', '\\'}) // escape back slash \ -> \\
+	data = bytes.ReplaceAll(data, []byte{'/'}, []byte{'\\', '/'})   // escape forward slash  / -> \/
+	return data
+}
+
+// fitEscaped returns how many bytes from the start of data take up no more
+// than size bytes once escaped
+func fitEscaped(data []byte, size int) int {
+	for i, b := range data {
+		if b == '/' || b == '\\' {
+			size--
+		}
+		if size--; size < 0 {
+			return i
+		}
+	}
+	return len(data)
+}
+
+// unescape data, rejecting any unescaped forward slash
+func unescape(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case '/':
+			return nil, errors.New("found-unescaped-slashes")
+		case '\\':
+			if i++; i == len(data) || (data[i] != '/' && data[i] != '\\') {
+				return nil, errors.New("bad-escape")
+			}
+		}
+		out = append(out, data[i])
+	}
+	return out, nil
+}
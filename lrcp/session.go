@@ -0,0 +1,494 @@
+package lrcp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Retransmission timeouts start at initialRTO, then follow the measured
+	// round trip time, doubling on every timeout up to maxRTO
+	initialRTO = time.Second
+	minRTO     = 100 * time.Millisecond
+	maxRTO     = 3 * time.Second
+
+	defaultSessionTimeout = 30 * time.Second
+
+	// defaultWindow bounds both data received but not yet read, and data
+	// sent but not yet acknowledged
+	defaultWindow = 64 << 10
+)
+
+// ErrSessionExpired is returned by reads and writes once the peer has been
+// silent for longer than the session timeout
+var ErrSessionExpired = errors.New("lrcp: session expired")
+
+// Session is one LRCP connection. It implements net.Conn.
+type Session struct {
+	ID     int
+	Remote net.Addr
+
+	lastSeen atomic.Int64  // unix nanoseconds
+	timeout  time.Duration // how long the peer may go silent, or leave sent data unacknowledged
+
+	InLock       sync.Mutex
+	buffer       []byte // received but not yet read
+	received     int    // how much has been received in all, which is what we ack
+	window       int    // the most buffer may hold
+	windowFull   bool   // whether data has been refused for want of room
+	readDeadline time.Time
+	readable     chan struct{} // signalled when there is more to read or the deadline moves
+
+	OutLock          sync.Mutex
+	LargestAckLength int
+	OutBuffer        []byte // sent but not yet acknowledged, from LargestAckLength on
+	sendWindow       int    // the most OutBuffer may hold
+	writeDeadline    time.Time
+	writable         chan struct{} // signalled when acks make room in OutBuffer or the deadline moves
+	srtt, rttvar     time.Duration // smoothed round trip time and its variation
+	rto              time.Duration // current retransmission timeout
+	retransmitAt     time.Time     // when to retransmit unacknowledged data
+	timedPos         int           // the end of the data being timed, or 0
+	timedAt          time.Time     // when that data was sent
+	fastResent       bool          // resent on a repeated ack since the last progress or timeout
+	waitingSince     time.Time     // when the peer last acked anything, or data started waiting for it
+	kick             chan struct{} // wakes the Retrier when there is new data to time
+
+	connected chan struct{} // closed once the peer acks our connect
+	done      chan struct{} // closed once the session closes
+	closeOnce sync.Once
+	closeErr  error // returned by Read once done
+	dialed    bool  // whether the session owns l
+
+	l *Listener
+}
+
+func newSession(l *Listener, id int, remote net.Addr) *Session {
+	sess := &Session{
+		ID:         id,
+		Remote:     remote,
+		timeout:    l.sessionTimeout,
+		window:     l.receiveWindow,
+		readable:   make(chan struct{}, 1),
+		sendWindow: l.sendWindow,
+		writable:   make(chan struct{}, 1),
+		rto:        initialRTO,
+		kick:       make(chan struct{}, 1),
+		connected:  make(chan struct{}),
+		done:       make(chan struct{}),
+		l:          l,
+	}
+	sess.touch()
+	return sess
+}
+
+// LastSeen is when a packet last arrived from the peer
+func (sess *Session) LastSeen() time.Time {
+	return time.Unix(0, sess.lastSeen.Load())
+}
+
+func (sess *Session) touch() {
+	sess.lastSeen.Store(time.Now().UnixNano())
+}
+
+// Read reads data received from the peer. It returns io.EOF once the peer
+// has closed the session and everything it sent has been read.
+func (sess *Session) Read(p []byte) (int, error) {
+	for {
+		sess.InLock.Lock()
+		if len(sess.buffer) > 0 {
+			n := copy(p, sess.buffer)
+			sess.buffer = sess.buffer[n:]
+
+			// Once there's room again for a good amount of what was
+			// refused, repeat our ack to have the peer resend it
+			update := sess.windowFull && sess.window-len(sess.buffer) >= (sess.window+1)/2
+			if update {
+				sess.windowFull = false
+			}
+			received := sess.received
+			sess.InLock.Unlock()
+
+			if update {
+				sess.l.reply(fmt.Sprintf("/ack/%d/%d/", sess.ID, received), sess.Remote)
+			}
+			return n, nil
+		}
+		deadline := sess.readDeadline
+		sess.InLock.Unlock()
+
+		select {
+		case <-sess.done:
+			return 0, sess.closeErr
+		default:
+		}
+
+		if deadline.IsZero() {
+			select {
+			case <-sess.readable:
+			case <-sess.done:
+			}
+			continue
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-sess.readable:
+		case <-sess.done:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// Write sends p to the peer, retransmitting until it is acknowledged. It
+// blocks while the peer has too much left to acknowledge.
+func (sess *Session) Write(p []byte) (int, error) {
+	written := 0
+	for {
+		select {
+		case <-sess.done:
+			if sess.closeErr == ErrSessionExpired {
+				return written, ErrSessionExpired
+			}
+			return written, net.ErrClosed
+		default:
+		}
+
+		sess.OutLock.Lock()
+		deadline := sess.writeDeadline
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			sess.OutLock.Unlock()
+			return written, os.ErrDeadlineExceeded
+		}
+		if n := sess.sendWindow - len(sess.OutBuffer); n > 0 && written < len(p) {
+			if n > len(p)-written {
+				n = len(p) - written
+			}
+			sess.sendData(p[written : written+n])
+			written += n
+		}
+		sess.OutLock.Unlock()
+		if written == len(p) {
+			return written, nil
+		}
+
+		if deadline.IsZero() {
+			select {
+			case <-sess.writable:
+			case <-sess.done:
+			}
+			continue
+		}
+		t := time.NewTimer(time.Until(deadline))
+		select {
+		case <-sess.writable:
+		case <-sess.done:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// Close tells the peer the session is over
+func (sess *Session) Close() error {
+	select {
+	case <-sess.done:
+		return nil
+	default:
+	}
+	sess.l.reply(fmt.Sprintf("/close/%d/", sess.ID), sess.Remote)
+	sess.finish(net.ErrClosed)
+	return nil
+}
+
+// finish forgets the session, waking anything blocked on it. Reads then
+// return err.
+func (sess *Session) finish(err error) {
+	sess.closeOnce.Do(func() {
+		sess.closeErr = err
+		close(sess.done)
+
+		sess.l.SessionLock.Lock()
+		if sess.l.Sessions[sess.ID] == sess {
+			delete(sess.l.Sessions, sess.ID)
+		}
+		sess.l.SessionLock.Unlock()
+
+		if sess.dialed {
+			sess.l.conn.Close()
+		}
+	})
+}
+
+func (sess *Session) LocalAddr() net.Addr  { return sess.l.conn.LocalAddr() }
+func (sess *Session) RemoteAddr() net.Addr { return sess.Remote }
+
+func (sess *Session) SetDeadline(t time.Time) error {
+	sess.SetReadDeadline(t)
+	return sess.SetWriteDeadline(t)
+}
+
+func (sess *Session) SetReadDeadline(t time.Time) error {
+	sess.InLock.Lock()
+	sess.readDeadline = t
+	sess.InLock.Unlock()
+	sess.signalReadable()
+	return nil
+}
+
+func (sess *Session) SetWriteDeadline(t time.Time) error {
+	sess.OutLock.Lock()
+	sess.writeDeadline = t
+	sess.OutLock.Unlock()
+	signal(sess.writable)
+	return nil
+}
+
+func (sess *Session) signalReadable() {
+	signal(sess.readable)
+}
+
+// signal wakes whatever waits on c, if anything is
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func (sess *Session) handleData(pos int, data []byte) {
+	sess.InLock.Lock()
+	lengthReceived := sess.received
+
+	if lengthReceived < pos {
+		if len(sess.buffer) >= sess.window {
+			// No room for the missing data either, so refuse it like below
+			sess.windowFull = true
+			sess.InLock.Unlock()
+			return
+		}
+		// Not received everything up to POS; send a duplicate of previous ack
+		sess.InLock.Unlock()
+		sess.l.reply(fmt.Sprintf("/ack/%d/%d/", sess.ID, lengthReceived), sess.Remote)
+		return
+	}
+
+	// Keep whatever of data we don't already have and have room for. The
+	// rest goes unacknowledged, so the peer will send it again.
+	if end := pos + len(data); end > lengthReceived {
+		data = data[lengthReceived-pos:]
+		if room := sess.window - len(sess.buffer); len(data) > room {
+			data = data[:room]
+			sess.windowFull = true
+		}
+		if len(data) == 0 {
+			// Refused for lack of room. Answer only data starting right
+			// where we are, which a resend's first datagram does, so the
+			// peer knows we're still here without being prompted to resend
+			// for every datagram. Read acks once there's room again.
+			sess.InLock.Unlock()
+			if pos == lengthReceived {
+				sess.l.reply(fmt.Sprintf("/ack/%d/%d/", sess.ID, lengthReceived), sess.Remote)
+			}
+			return
+		}
+		sess.buffer = append(sess.buffer, data...)
+		sess.received += len(data)
+	}
+	length := sess.received
+	sess.InLock.Unlock()
+
+	sess.l.reply(fmt.Sprintf("/ack/%d/%d/", sess.ID, length), sess.Remote)
+
+	// Pass up to application layer
+	if length > lengthReceived {
+		sess.signalReadable()
+	}
+}
+
+func (sess *Session) handleAck(length int) {
+	select {
+	case <-sess.connected:
+	default:
+		close(sess.connected)
+	}
+
+	sess.OutLock.Lock()
+	defer sess.OutLock.Unlock()
+	// Even an ack that makes no progress shows the peer is still there,
+	// such as one whose receive window is full
+	sess.waitingSince = time.Now()
+	if length < sess.LargestAckLength {
+		// do nothing and stop (assume it's a duplicate ack that got delayed).
+		log.Printf("lrcp dropping duplicate ack %d < %d\n", length, sess.LargestAckLength)
+		return
+	} else if sent := sess.LargestAckLength + len(sess.OutBuffer); length > sent {
+		// The peer is misbehaving: close the session.
+		log.Printf("lrcp at=ack.err misbehaving-peer %d > %d\n", length, sent)
+		sess.OutLock.Unlock()
+		sess.Close()
+		sess.OutLock.Lock()
+		return
+	}
+
+	if length > sess.LargestAckLength {
+		sess.OutBuffer = sess.OutBuffer[length-sess.LargestAckLength:]
+		sess.LargestAckLength = length
+		log.Printf("lrcp updated ack to %d\n", sess.LargestAckLength)
+		signal(sess.writable)
+
+		if sess.timedPos > 0 && length >= sess.timedPos {
+			sess.sampleRTT(time.Since(sess.timedAt))
+		}
+		// Progress restarts the timer for whatever is still outstanding,
+		// which is most likely still in flight
+		sess.retransmitAt = time.Now().Add(sess.rto)
+		sess.fastResent = false
+	} else if len(sess.OutBuffer) > 0 && !sess.fastResent {
+		// A repeated ack means the peer is missing what follows it:
+		// retransmit all payload data after the first LENGTH bytes. Every
+		// datagram of a resend may be answered with the same ack, so only
+		// act on the first; the timer takes care of it after that.
+		sess.fastResent = true
+		log.Printf("lrcp retransmitting %d < %d\n", length, length+len(sess.OutBuffer))
+		sess.resend()
+	}
+}
+
+// sampleRTT folds a round trip measurement into the retransmission
+// timeout, as TCP does (RFC 6298). The caller must hold OutLock.
+func (sess *Session) sampleRTT(rtt time.Duration) {
+	if sess.srtt == 0 {
+		sess.srtt, sess.rttvar = rtt, rtt/2
+	} else {
+		delta := sess.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		sess.rttvar = (3*sess.rttvar + delta) / 4
+		sess.srtt = (7*sess.srtt + rtt) / 8
+	}
+	sess.timedPos = 0
+
+	sess.rto = sess.srtt + 4*sess.rttvar
+	if sess.rto < minRTO {
+		sess.rto = minRTO
+	} else if limit := sess.rtoLimit(); sess.rto > limit {
+		sess.rto = limit
+	}
+}
+
+// rtoLimit is the most the retransmission timeout backs off to: maxRTO, or
+// less with a short session timeout so that a peer which can't take more
+// data still hears from us, and answers, well within it
+func (sess *Session) rtoLimit() time.Duration {
+	if limit := sess.timeout / 2; limit < maxRTO {
+		return limit
+	}
+	return maxRTO
+}
+
+// sendData sends p and keeps it for retransmission. The caller must hold
+// OutLock.
+func (sess *Session) sendData(p []byte) {
+	now := time.Now()
+	if len(sess.OutBuffer) == 0 {
+		// Nothing was outstanding, so the timers start now
+		sess.retransmitAt = now.Add(sess.rto)
+		sess.waitingSince = now
+		signal(sess.kick)
+	}
+
+	pos := sess.LargestAckLength + len(sess.OutBuffer)
+	sess.OutBuffer = append(sess.OutBuffer, p...)
+	sess.transmit(pos, p)
+	if sess.timedPos == 0 {
+		sess.timedPos, sess.timedAt = pos+len(p), now
+	}
+}
+
+// resend retransmits all unacknowledged data. The caller must hold OutLock.
+func (sess *Session) resend() {
+	// An ack for retransmitted data can't be told apart from one for the
+	// original, so it says nothing about the round trip time
+	sess.timedPos = 0
+	sess.transmit(sess.LargestAckLength, sess.OutBuffer)
+}
+
+// transmit sends data, which starts at pos in the stream, split into as
+// few data messages as fit in a datagram once escaped
+func (sess *Session) transmit(pos int, data []byte) {
+	for len(data) > 0 {
+		header := fmt.Sprintf("/data/%d/%d/", sess.ID, pos)
+		n := fitEscaped(data, maxPacketSize-len(header)-len("/")-1)
+		sess.l.reply(header+string(escape(data[:n]))+"/", sess.Remote)
+		pos, data = pos+n, data[n:]
+	}
+}
+
+// Retrier retransmits unacknowledged data whenever the retransmission
+// timeout passes without progress, backing off each time. It expires the
+// session once the peer has been silent for too long, or has sent nothing
+// but data for too long while ours waits for an ack.
+func (sess *Session) Retrier() {
+	timer := time.NewTimer(sess.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-sess.kick:
+			timer.Stop()
+			select {
+			case <-timer.C:
+			default:
+			}
+		case <-sess.done:
+			return
+		}
+
+		now := time.Now()
+		expireAt := sess.LastSeen().Add(sess.timeout)
+		sess.OutLock.Lock()
+		outstanding := len(sess.OutBuffer) > 0
+		if outstanding {
+			if ackBy := sess.waitingSince.Add(sess.timeout); ackBy.Before(expireAt) {
+				expireAt = ackBy
+			}
+		}
+		if !now.Before(expireAt) {
+			sess.OutLock.Unlock()
+			log.Printf("lrcp at=session.expired session=%d remote-addr=%q\n", sess.ID, sess.Remote)
+			sess.l.reply(fmt.Sprintf("/close/%d/", sess.ID), sess.Remote)
+			sess.finish(ErrSessionExpired)
+			return
+		}
+
+		wait := expireAt.Sub(now)
+		if outstanding {
+			if !now.Before(sess.retransmitAt) {
+				// retransmit all payload data after the largest ack length
+				sess.resend()
+				sess.fastResent = false
+				if sess.rto *= 2; sess.rto > sess.rtoLimit() {
+					sess.rto = sess.rtoLimit()
+				}
+				sess.retransmitAt = now.Add(sess.rto)
+			}
+			if until := sess.retransmitAt.Sub(now); until < wait {
+				wait = until
+			}
+		}
+		sess.OutLock.Unlock()
+		timer.Reset(wait)
+	}
+}
@@ -0,0 +1,394 @@
+package lrcp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fanatic/protohackers/lrcp/lrcptest"
+)
+
+// recorder is a net.PacketConn that keeps everything written to it
+type recorder struct {
+	mu      sync.Mutex
+	packets [][]byte
+}
+
+func (r *recorder) WriteTo(p []byte, addr net.Addr) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.packets = append(r.packets, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (r *recorder) take() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	packets := r.packets
+	r.packets = nil
+	return packets
+}
+
+func (r *recorder) ReadFrom(p []byte) (int, net.Addr, error) { return 0, nil, net.ErrClosed }
+func (r *recorder) Close() error                             { return nil }
+func (r *recorder) LocalAddr() net.Addr                      { return &net.UDPAddr{} }
+func (r *recorder) SetDeadline(t time.Time) error            { return nil }
+func (r *recorder) SetReadDeadline(t time.Time) error        { return nil }
+func (r *recorder) SetWriteDeadline(t time.Time) error       { return nil }
+
+// slashy returns n random bytes, most of them slashes and backslashes
+func slashy(rng *rand.Rand, n int) []byte {
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = "//\\\\\\a\n"[rng.Intn(7)]
+	}
+	return p
+}
+
+// reassemble checks every datagram is a valid data message under the size
+// limit, and lays their contents out at their positions
+func reassemble(t *testing.T, packets [][]byte, into []byte) []byte {
+	t.Helper()
+	for _, packet := range packets {
+		if len(packet) >= maxPacketSize {
+			t.Fatalf("%d byte datagram", len(packet))
+		}
+		msg, err := parseMessage(packet)
+		if err != nil || msg.Type != "data" {
+			t.Fatalf("bad datagram %q: %v", packet, err)
+		}
+		if msg.Pos > len(into) {
+			t.Fatalf("data at %d leaves a gap after %d", msg.Pos, len(into))
+		}
+		if end := msg.Pos + len(msg.Data); end > len(into) {
+			into = append(into, make([]byte, end-len(into))...)
+		}
+		copy(into[msg.Pos:], msg.Data)
+	}
+	return into
+}
+
+func TestSendChunking(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		rec := &recorder{}
+		sess := newSession(newListener(rec, nil), rng.Intn(maxNumber), &net.UDPAddr{})
+
+		var want, got []byte
+		for w := rng.Intn(10); w >= 0; w-- {
+			p := slashy(rng, []int{0, 1, 2, rng.Intn(100), rng.Intn(3000)}[rng.Intn(5)])
+			sess.Write(p)
+			want = append(want, p...)
+			got = reassemble(t, rec.take(), got)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("sent %q, got %q", want, got)
+		}
+
+		// Retransmitting after any ack must line up with the original
+		ack := rng.Intn(len(want) + 1)
+		sess.handleAck(ack)
+		rec.take()
+		sess.OutLock.Lock()
+		sess.resend()
+		sess.OutLock.Unlock()
+		resent := want[:ack:ack]
+		if resent = reassemble(t, rec.take(), resent); !bytes.Equal(resent, want) {
+			t.Fatalf("sent %q, resent %q", want, resent)
+		}
+	}
+}
+
+func TestFitEscaped(t *testing.T) {
+	tests := []struct {
+		data string
+		size int
+		want int
+	}{
+		{"", 10, 0},
+		{"abc", 3, 3},
+		{"abc", 2, 2},
+		{"a/b", 3, 2},
+		{"a/b", 4, 3},
+		{"//", 3, 1},
+		{"\\", 1, 0},
+		{"\\", 2, 1},
+	}
+	for _, tc := range tests {
+		if got := fitEscaped([]byte(tc.data), tc.size); got != tc.want {
+			t.Errorf("fitEscaped(%q, %d) = %d, want %d", tc.data, tc.size, got, tc.want)
+		}
+	}
+}
+
+// rawPeer is the far end of a session, speaking LRCP by hand
+type rawPeer struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func dialRaw(t *testing.T, addr string) *rawPeer {
+	t.Helper()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &rawPeer{t, conn}
+}
+
+func (p *rawPeer) send(msg string) {
+	p.t.Helper()
+	if _, err := p.conn.Write([]byte(msg)); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func (p *rawPeer) expect(msg string) {
+	p.t.Helper()
+	buf := make([]byte, maxPacketSize)
+	p.conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := p.conn.Read(buf)
+	if err != nil {
+		p.t.Fatalf("waiting for %q: %v", msg, err)
+	}
+	if string(buf[:n]) != msg {
+		p.t.Fatalf("got %q, want %q", buf[:n], msg)
+	}
+}
+
+// expectNothing checks the peer is sent nothing for a while
+func (p *rawPeer) expectNothing(d time.Duration) {
+	p.t.Helper()
+	buf := make([]byte, maxPacketSize)
+	p.conn.SetReadDeadline(time.Now().Add(d))
+	if n, err := p.conn.Read(buf); err == nil {
+		p.t.Fatalf("got %q, want nothing", buf[:n])
+	}
+}
+
+func TestReceiveWindow(t *testing.T) {
+	l, err := Listen("127.0.0.1:0", WithReceiveWindow(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	peer := dialRaw(t, l.Addr().String())
+	peer.send("/connect/7/")
+	peer.expect("/ack/7/0/")
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only as much as fits is acknowledged
+	peer.send("/data/7/0/0123456789abcdef/")
+	peer.expect("/ack/7/10/")
+	// Data refused for want of room is answered with the old ack, so the
+	// peer knows we're alive, but only where it starts at our position
+	peer.send("/data/7/10/abcdef/")
+	peer.expect("/ack/7/10/")
+	peer.send("/data/7/13/def/")
+	peer.expectNothing(100 * time.Millisecond)
+
+	// Reading a little doesn't make enough room to be worth announcing
+	buf := make([]byte, 10)
+	if n, _ := c.Read(buf[:4]); string(buf[:n]) != "0123" {
+		t.Fatalf("read %q", buf[:n])
+	}
+	if n, _ := c.Read(buf); string(buf[:n]) != "456789" {
+		t.Fatalf("read %q", buf[:n])
+	}
+	peer.expect("/ack/7/10/")
+
+	peer.send("/data/7/10/abcdef/")
+	peer.expect("/ack/7/16/")
+	if n, _ := c.Read(buf); string(buf[:n]) != "abcdef" {
+		t.Fatalf("read %q", buf[:n])
+	}
+}
+
+func TestInvalidWindows(t *testing.T) {
+	l, err := Listen("127.0.0.1:0", WithReceiveWindow(-1), WithSendWindow(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Windows that could never hold anything are ignored
+	peer := dialRaw(t, l.Addr().String())
+	peer.send("/connect/7/")
+	peer.expect("/ack/7/0/")
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.send("/data/7/0/hello/")
+	peer.expect("/ack/7/5/")
+	buf := make([]byte, 10)
+	if n, _ := c.Read(buf); string(buf[:n]) != "hello" {
+		t.Fatalf("read %q", buf[:n])
+	}
+	c.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := c.Write([]byte("olleh")); err != nil {
+		t.Fatal(err)
+	}
+	peer.expect("/data/7/0/olleh/")
+}
+
+func TestSendWindow(t *testing.T) {
+	l, err := Listen("127.0.0.1:0", WithSendWindow(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	peer := dialRaw(t, l.Addr().String())
+	peer.send("/connect/7/")
+	peer.expect("/ack/7/0/")
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(chan int)
+	go func() {
+		n, _ := c.Write([]byte("0123456789abcdefghijklmno"))
+		written <- n
+	}()
+
+	peer.expect("/data/7/0/0123456789/")
+	select {
+	case n := <-written:
+		t.Fatalf("wrote %d bytes with only 10 acknowledged", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+	peer.send("/ack/7/10/")
+	peer.expect("/data/7/10/abcdefghij/")
+	peer.send("/ack/7/20/")
+	peer.expect("/data/7/20/klmno/")
+	if n := <-written; n != 25 {
+		t.Fatalf("wrote %d bytes", n)
+	}
+
+	// With 5 bytes still unacknowledged, only 5 more fit
+	c.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := c.Write([]byte("pqrstuvwxyz"))
+	if n != 5 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("wrote %d bytes, err %v", n, err)
+	}
+	peer.expect("/data/7/25/pqrst/")
+}
+
+func TestBackPressure(t *testing.T) {
+	const window = 1000
+	serverConn, clientConn := lossyConn(t, lrcptest.Config{}), lossyConn(t, lrcptest.Config{})
+	l := NewListener(serverConn, WithReceiveWindow(window))
+	defer l.Close()
+
+	conn, err := DialPacket(clientConn, l.Addr().String(), WithSendWindow(2*window))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := conn.(*Session)
+
+	want := slashy(rand.New(rand.NewSource(1)), 50000)
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(want)
+		written <- err
+	}()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := c.(*Session)
+
+	// An app that isn't reading holds up the writer at the far end, without
+	// the two ends bouncing the same data and acks back and forth
+	time.Sleep(time.Second)
+	if sent := serverConn.Stats().Written + clientConn.Stats().Written; sent > 50 {
+		t.Errorf("%d datagrams sent while the reader was stalled", sent)
+	}
+	select {
+	case err := <-written:
+		t.Fatalf("write finished with nothing read: %v", err)
+	default:
+	}
+	server.InLock.Lock()
+	buffered := len(server.buffer)
+	server.InLock.Unlock()
+	client.OutLock.Lock()
+	outstanding := len(client.OutBuffer)
+	client.OutLock.Unlock()
+	if buffered != window || outstanding > 2*window {
+		t.Fatalf("%d bytes buffered and %d outstanding", buffered, outstanding)
+	}
+
+	// Reading lets it through
+	got := make([]byte, len(want))
+	c.SetReadDeadline(time.Now().Add(30 * time.Second))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("received data differs from what was sent")
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSlowReaderStaysOpen(t *testing.T) {
+	const window = 1000
+	timeout := 600 * time.Millisecond
+	l := NewListener(lossyConn(t, lrcptest.Config{}), WithReceiveWindow(window), WithSessionTimeout(timeout))
+	defer l.Close()
+
+	conn, err := DialPacket(lossyConn(t, lrcptest.Config{}), l.Addr().String(), WithSendWindow(window), WithSessionTimeout(timeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	want := slashy(rand.New(rand.NewSource(1)), 3*window)
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(want)
+		written <- err
+	}()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A full window stops acks making progress, but both ends are still
+	// there, so neither expires however long the reader takes
+	got := make([]byte, 0, len(want))
+	buf := make([]byte, window)
+	c.SetReadDeadline(time.Now().Add(30 * time.Second))
+	for len(got) < len(want) {
+		time.Sleep(2 * timeout)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("after reading %d bytes: %v", len(got), err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("received data differs from what was sent")
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Framing splits a byte stream into messages and frames messages back into
+// a byte stream
+type Framing interface {
+	// Split is a bufio.SplitFunc yielding one message per token
+	Split(data []byte, atEOF bool) (advance int, token []byte, err error)
+
+	// Frame encodes msg for writing
+	Frame(msg []byte) []byte
+}
+
+// Lines frames messages as newline-terminated lines. A trailing '\r' is
+// dropped, and a partial line at EOF is discarded rather than forwarded.
+var Lines Framing = lines{}
+
+type lines struct{}
+
+func (lines) Split(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		// We have a full newline-terminated line.
+		return i + 1, dropCR(data[0:i]), nil
+	}
+	// Request more data, or drop the unterminated remainder at EOF.
+	return 0, nil, nil
+}
+
+func (lines) Frame(msg []byte) []byte {
+	return append(append(make([]byte, 0, len(msg)+1), msg...), '\n')
+}
+
+func dropCR(data []byte) []byte {
+	if len(data) > 0 && data[len(data)-1] == '\r' {
+		return data[0 : len(data)-1]
+	}
+	return data
+}
+
+// LengthPrefixed frames messages with a 4-byte big-endian length. A partial
+// message at EOF is discarded.
+var LengthPrefixed Framing = lengthPrefixed{}
+
+type lengthPrefixed struct{}
+
+func (lengthPrefixed) Split(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) < 4 {
+		return 0, nil, nil
+	}
+	n := uint64(binary.BigEndian.Uint32(data))
+	if uint64(len(data)) < 4+n {
+		return 0, nil, nil
+	}
+	return 4 + int(n), data[4 : 4+n], nil
+}
+
+func (lengthPrefixed) Frame(msg []byte) []byte {
+	b := make([]byte, 4, 4+len(msg))
+	binary.BigEndian.PutUint32(b, uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// Raw passes bytes through unframed; each message is whatever was read
+var Raw Framing = raw{}
+
+type raw struct{}
+
+func (raw) Split(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, nil
+	}
+	return len(data), data, nil
+}
+
+func (raw) Frame(msg []byte) []byte {
+	return msg
+}
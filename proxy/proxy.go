@@ -0,0 +1,168 @@
+// Package proxy relays framed messages between a client and an upstream
+// server, passing each one through a chain of middleware on the way.
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Direction is which way a message is travelling through the proxy
+type Direction int
+
+const (
+	ClientToServer Direction = iota
+	ServerToClient
+)
+
+func (d Direction) String() string {
+	switch d {
+	case ClientToServer:
+		return "client-to-server"
+	case ServerToClient:
+		return "server-to-client"
+	}
+	return fmt.Sprintf("Direction(%d)", int(d))
+}
+
+// Middleware sees each message on its way through the proxy. It forwards
+// the message, possibly rewritten, by calling next, or drops it by
+// returning without doing so. It may inject messages with sess.Send.
+// msg must not be modified and is only valid until the middleware returns.
+type Middleware func(sess *Session, d Direction, msg []byte, next func(msg []byte) error) error
+
+type Proxy struct {
+	// Framing splits streams into messages, defaulting to Lines
+	Framing Framing
+
+	// Middleware is applied in order to every message
+	Middleware []Middleware
+
+	// MaxMessageSize is the largest message accepted, defaulting to
+	// bufio.MaxScanTokenSize
+	MaxMessageSize int
+
+	// Linger, if set, is how long one side may keep sending after the
+	// other has finished before the session is torn down
+	Linger time.Duration
+}
+
+// Stats counts what a session sent in each direction, indexed by Direction
+type Stats struct {
+	Messages [2]int64
+	Bytes    [2]int64
+}
+
+// Session is one client's connection through the proxy
+type Session struct {
+	proxy *Proxy
+	conns [2]net.Conn // by the direction of messages written to them
+	mu    [2]sync.Mutex
+	stats Stats
+}
+
+// Serve relays messages between client and upstream. When either side
+// finishes sending, the other is half-closed so it can finish in turn; an
+// error in either direction, or lingering too long, tears both down. Both
+// connections are closed by the time Serve returns.
+func (p *Proxy) Serve(client, upstream net.Conn) (Stats, error) {
+	sess := &Session{proxy: p, conns: [2]net.Conn{upstream, client}}
+
+	errs := make(chan error, 2)
+	for _, d := range []Direction{ClientToServer, ServerToClient} {
+		d := d
+		go func() {
+			err := sess.relay(d)
+			if err != nil {
+				client.Close()
+				upstream.Close()
+			} else {
+				closeWrite(sess.conns[d])
+				if p.Linger > 0 {
+					sess.conns[d].SetReadDeadline(time.Now().Add(p.Linger))
+				}
+			}
+			errs <- err
+		}()
+	}
+
+	var err error
+	for i := 0; i < 2; i++ {
+		e := <-errs
+		if err == nil && !errors.Is(e, net.ErrClosed) && !errors.Is(e, os.ErrDeadlineExceeded) {
+			err = e
+		}
+	}
+	client.Close()
+	upstream.Close()
+	return sess.stats, err
+}
+
+// Send frames msg and writes it to the side it is travelling towards,
+// skipping any middleware
+func (s *Session) Send(d Direction, msg []byte) error {
+	s.mu[d].Lock()
+	defer s.mu[d].Unlock()
+	n, err := s.conns[d].Write(s.proxy.framing().Frame(msg))
+	s.stats.Bytes[d] += int64(n)
+	if err == nil {
+		s.stats.Messages[d]++
+	}
+	return err
+}
+
+// relay reads messages from the side opposite d and passes them through
+// the middleware until that side stops sending
+func (s *Session) relay(d Direction) error {
+	max := s.proxy.MaxMessageSize
+	if max <= 0 {
+		max = bufio.MaxScanTokenSize
+	}
+	scanner := bufio.NewScanner(s.conns[1-d])
+	scanner.Buffer(make([]byte, 0, 4096), max)
+	scanner.Split(s.proxy.framing().Split)
+	for scanner.Scan() {
+		if err := s.handle(0, d, scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *Session) handle(i int, d Direction, msg []byte) error {
+	if i == len(s.proxy.Middleware) {
+		return s.Send(d, msg)
+	}
+	return s.proxy.Middleware[i](s, d, msg, func(msg []byte) error {
+		return s.handle(i+1, d, msg)
+	})
+}
+
+func (p *Proxy) framing() Framing {
+	if p.Framing == nil {
+		return Lines
+	}
+	return p.Framing
+}
+
+// closeWrite shuts down the writing side of c, closing it entirely if it
+// can't be half-closed
+func closeWrite(c net.Conn) {
+	switch conn := c.(type) {
+	case interface{ CloseWrite() error }:
+		conn.CloseWrite()
+		return
+	case interface{ TCPConn() (*net.TCPConn, bool) }:
+		// A proxyproto.Conn wraps the TCP connection we need
+		if tc, ok := conn.TCPConn(); ok {
+			tc.CloseWrite()
+			return
+		}
+	}
+	c.Close()
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serve starts p in front of an echo server, returning the proxy's address
+// and where the stats of each finished session are sent
+func serve(t *testing.T, p *Proxy) (string, chan Stats) {
+	t.Helper()
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	stats := make(chan Stats, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", echo.Addr().String())
+			if err != nil {
+				c.Close()
+				continue
+			}
+			go func() {
+				st, _ := p.Serve(c, upstream)
+				stats <- st
+			}()
+		}
+	}()
+	return l.Addr().String(), stats
+}
+
+// roundTrip sends input through the proxy, half-closes, and returns
+// everything that comes back
+func roundTrip(t *testing.T, addr string, input []byte) []byte {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write(input); err != nil {
+		t.Fatal(err)
+	}
+	c.(*net.TCPConn).CloseWrite()
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestProxy(t *testing.T) {
+	t.Run("lines with middleware", func(t *testing.T) {
+		p := &Proxy{Middleware: []Middleware{
+			func(sess *Session, d Direction, msg []byte, next func([]byte) error) error {
+				switch {
+				case d == ClientToServer && string(msg) == "drop":
+					return nil
+				case d == ClientToServer && string(msg) == "ping":
+					return sess.Send(ServerToClient, []byte("pong"))
+				case d == ClientToServer:
+					return next(bytes.ToUpper(msg))
+				}
+				return next(append([]byte("echo: "), msg...))
+			},
+			func(sess *Session, d Direction, msg []byte, next func([]byte) error) error {
+				if d == ServerToClient {
+					return next(append(append([]byte{}, msg...), '!'))
+				}
+				return next(msg)
+			},
+		}}
+		addr, stats := serve(t, p)
+
+		got := roundTrip(t, addr, []byte("ping\nhello\r\ndrop\nworld\npartial"))
+		want := "pong\necho: HELLO!\necho: WORLD!\n"
+		if string(got) != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+
+		st := <-stats
+		if st.Messages != [2]int64{2, 3} {
+			t.Errorf("got %v messages each way, want [2 3]", st.Messages)
+		}
+		if st.Bytes != [2]int64{12, int64(len(want))} {
+			t.Errorf("got %v bytes each way, want [12 %d]", st.Bytes, len(want))
+		}
+	})
+
+	t.Run("length prefixed", func(t *testing.T) {
+		p := &Proxy{Framing: LengthPrefixed, Middleware: []Middleware{
+			func(sess *Session, d Direction, msg []byte, next func([]byte) error) error {
+				if d == ServerToClient {
+					return next(bytes.Repeat(msg, 2))
+				}
+				return next(msg)
+			},
+		}}
+		addr, _ := serve(t, p)
+
+		input := append(LengthPrefixed.Frame([]byte("ab\ncd")), LengthPrefixed.Frame(nil)...)
+		input = append(input, 0, 0, 0, 9, 'x')
+		got := roundTrip(t, addr, input)
+		want := append(LengthPrefixed.Frame([]byte("ab\ncdab\ncd")), LengthPrefixed.Frame(nil)...)
+		if !bytes.Equal(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("raw", func(t *testing.T) {
+		p := &Proxy{Framing: Raw}
+		addr, _ := serve(t, p)
+
+		input := bytes.Repeat([]byte("no framing\x00at all"), 10000)
+		got := roundTrip(t, addr, input)
+		if !bytes.Equal(got, input) {
+			t.Errorf("got %d bytes, want %d", len(got), len(input))
+		}
+	})
+}
+
+func TestProxyLinger(t *testing.T) {
+	// An upstream that says goodbye and hangs up straight away
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		c, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		c.Write([]byte("bye\n"))
+		c.Close()
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan error)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		u, err := net.Dial("tcp", upstream.Addr().String())
+		if err != nil {
+			done <- err
+			return
+		}
+		p := &Proxy{Linger: 50 * time.Millisecond}
+		_, err = p.Serve(c, u)
+		done <- err
+	}()
+
+	// A client that reads to EOF but never hangs up
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	got, err := io.ReadAll(c)
+	if err != nil || string(got) != "bye\n" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session outlived its linger")
+	}
+}
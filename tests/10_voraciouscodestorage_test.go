@@ -2,8 +2,14 @@ package tests
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"fmt"
 	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	voraciouscodestorage "github.com/fanatic/protohackers/10_voraciouscodestorage"
@@ -48,7 +54,7 @@ func TestLevel10VoraciousCodeStorage(t *testing.T) {
 		require.NoError(t, err)
 
 		scanner.Scan()
-		assert.Equal(t, "OK usage: HELP|GET|PUT|LIST", scanner.Text())
+		assert.Equal(t, "OK usage: HELP|GET|PUT|LIST|HISTORY|DIFF|DELETE", scanner.Text())
 
 		scanner.Scan()
 		assert.Equal(t, "READY", scanner.Text())
@@ -73,11 +79,13 @@ func TestLevel10VoraciousCodeStorage(t *testing.T) {
 		})
 
 		t.Run("bad dir name", func(t *testing.T) {
-			_, err = conn.Write([]byte("list a\n"))
-			require.NoError(t, err)
+			for _, dir := range []string{"a", "//", "/b//", "/b//c"} {
+				_, err = conn.Write([]byte("list " + dir + "\n"))
+				require.NoError(t, err)
 
-			scanner.Scan()
-			assert.Equal(t, "ERR illegal dir name", scanner.Text())
+				scanner.Scan()
+				assert.Equal(t, "ERR illegal dir name", scanner.Text(), dir)
+			}
 		})
 
 		t.Run("empty dir", func(t *testing.T) {
@@ -131,6 +139,71 @@ func TestLevel10VoraciousCodeStorage(t *testing.T) {
 			scanner.Scan()
 			assert.Equal(t, "READY", scanner.Text())
 		})
+
+		t.Run("list file and dir of the same name", func(t *testing.T) {
+			_, err = conn.Write([]byte("put /b 0\n"))
+			require.NoError(t, err)
+			scanner.Scan()
+			assert.Equal(t, "OK r1", scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "READY", scanner.Text())
+
+			_, err = conn.Write([]byte("list /\n"))
+			require.NoError(t, err)
+
+			scanner.Scan()
+			assert.Equal(t, "OK 3", scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "a r1", scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "b r1", scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "b/ DIR", scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "READY", scanner.Text())
+		})
+
+		t.Run("list latest revision and unique dirs", func(t *testing.T) {
+			_, err = conn.Write([]byte("put /e/f 1\nx"))
+			require.NoError(t, err)
+			scanner.Scan()
+			assert.Equal(t, "OK r1", scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "READY", scanner.Text())
+
+			_, err = conn.Write([]byte("put /e/f 1\ny"))
+			require.NoError(t, err)
+			scanner.Scan()
+			assert.Equal(t, "OK r2", scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "READY", scanner.Text())
+
+			_, err = conn.Write([]byte("put /e/g/h 0\n"))
+			require.NoError(t, err)
+			scanner.Scan()
+			assert.Equal(t, "OK r1", scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "READY", scanner.Text())
+
+			_, err = conn.Write([]byte("put /e/g/i 0\n"))
+			require.NoError(t, err)
+			scanner.Scan()
+			assert.Equal(t, "OK r1", scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "READY", scanner.Text())
+
+			_, err = conn.Write([]byte("list /e/\n"))
+			require.NoError(t, err)
+
+			scanner.Scan()
+			assert.Equal(t, "OK 2", scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "f r2", scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "g/ DIR", scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "READY", scanner.Text())
+		})
 	})
 
 	t.Run("put", func(t *testing.T) {
@@ -151,6 +224,16 @@ func TestLevel10VoraciousCodeStorage(t *testing.T) {
 			assert.Equal(t, "ERR usage: PUT file length newline data", scanner.Text())
 		})
 
+		t.Run("put empty path segment", func(t *testing.T) {
+			for _, file := range []string{"/", "/a//b", "/a/b/"} {
+				_, err = conn.Write([]byte("put " + file + " 0\n"))
+				require.NoError(t, err)
+
+				scanner.Scan()
+				assert.Equal(t, "ERR illegal file name", scanner.Text(), file)
+			}
+		})
+
 		t.Run("put empty file", func(t *testing.T) {
 			_, err = conn.Write([]byte("put /c 0\n"))
 			require.NoError(t, err)
@@ -258,6 +341,166 @@ func TestLevel10VoraciousCodeStorage(t *testing.T) {
 		})
 	})
 
+	t.Run("history, diff and delete", func(t *testing.T) {
+		conn, err := net.Dial("tcp", s.Addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		scanner := bufio.NewScanner(conn)
+
+		scanner.Scan()
+		require.Equal(t, "READY", scanner.Text())
+
+		_, err = conn.Write([]byte("put /h/f 4\na\nb\n"))
+		require.NoError(t, err)
+		scanner.Scan()
+		assert.Equal(t, "OK r1", scanner.Text())
+		scanner.Scan()
+		assert.Equal(t, "READY", scanner.Text())
+
+		_, err = conn.Write([]byte("put /h/f 4\na\nc\n"))
+		require.NoError(t, err)
+		scanner.Scan()
+		assert.Equal(t, "OK r2", scanner.Text())
+		scanner.Scan()
+		assert.Equal(t, "READY", scanner.Text())
+
+		t.Run("history", func(t *testing.T) {
+			_, err = conn.Write([]byte("history /h/f\n"))
+			require.NoError(t, err)
+
+			scanner.Scan()
+			assert.Equal(t, "OK 2", scanner.Text())
+			scanner.Scan()
+			assert.Regexp(t, `^r1 4 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ$`, scanner.Text())
+			scanner.Scan()
+			assert.Regexp(t, `^r2 4 `, scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "READY", scanner.Text())
+		})
+
+		t.Run("history of missing file", func(t *testing.T) {
+			_, err = conn.Write([]byte("history /h/nope\n"))
+			require.NoError(t, err)
+
+			scanner.Scan()
+			assert.Equal(t, "ERR file does not exist", scanner.Text())
+		})
+
+		t.Run("diff", func(t *testing.T) {
+			_, err = conn.Write([]byte("diff /h/f r1 r2\n"))
+			require.NoError(t, err)
+
+			diff := "--- /h/f r1\n+++ /h/f r2\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n"
+			scanner.Scan()
+			assert.Equal(t, fmt.Sprintf("OK %d", len(diff)), scanner.Text())
+			for _, line := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+				scanner.Scan()
+				assert.Equal(t, line, scanner.Text())
+			}
+			scanner.Scan()
+			assert.Equal(t, "READY", scanner.Text())
+		})
+
+		t.Run("diff missing revision", func(t *testing.T) {
+			_, err = conn.Write([]byte("diff /h/f r1 r3\n"))
+			require.NoError(t, err)
+
+			scanner.Scan()
+			assert.Equal(t, "ERR revision does not exist", scanner.Text())
+		})
+
+		t.Run("delete", func(t *testing.T) {
+			_, err = conn.Write([]byte("delete /h/f\n"))
+			require.NoError(t, err)
+			scanner.Scan()
+			assert.Equal(t, "OK", scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "READY", scanner.Text())
+
+			_, err = conn.Write([]byte("delete /h/f\n"))
+			require.NoError(t, err)
+			scanner.Scan()
+			assert.Equal(t, "ERR file does not exist", scanner.Text())
+
+			_, err = conn.Write([]byte("get /h/f\n"))
+			require.NoError(t, err)
+			scanner.Scan()
+			assert.Equal(t, "ERR file does not exist", scanner.Text())
+
+			_, err = conn.Write([]byte("list /h\n"))
+			require.NoError(t, err)
+			scanner.Scan()
+			assert.Equal(t, "OK 0", scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "READY", scanner.Text())
+		})
+
+		t.Run("deleted file is readable by revision", func(t *testing.T) {
+			_, err = conn.Write([]byte("get /h/f r1\n"))
+			require.NoError(t, err)
+			scanner.Scan()
+			assert.Equal(t, "OK 4", scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "a", scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "b", scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "READY", scanner.Text())
+
+			_, err = conn.Write([]byte("history /h/f\n"))
+			require.NoError(t, err)
+			scanner.Scan()
+			assert.Equal(t, "OK 3", scanner.Text())
+			scanner.Scan()
+			scanner.Scan()
+			scanner.Scan()
+			assert.Regexp(t, `^DELETED `, scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "READY", scanner.Text())
+		})
+
+		t.Run("put after delete starts a new revision", func(t *testing.T) {
+			_, err = conn.Write([]byte("put /h/f 4\na\nc\n"))
+			require.NoError(t, err)
+			scanner.Scan()
+			assert.Equal(t, "OK r3", scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "READY", scanner.Text())
+
+			_, err = conn.Write([]byte("list /h\n"))
+			require.NoError(t, err)
+			scanner.Scan()
+			assert.Equal(t, "OK 1", scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "f r3", scanner.Text())
+			scanner.Scan()
+			assert.Equal(t, "READY", scanner.Text())
+		})
+
+		t.Run("history of a file deleted twice", func(t *testing.T) {
+			for _, cmd := range []string{"put /h/g 2\na\n", "delete /h/g\n", "put /h/g 2\nb\n", "delete /h/g\n"} {
+				_, err = conn.Write([]byte(cmd))
+				require.NoError(t, err)
+				scanner.Scan()
+				assert.Regexp(t, `^OK`, scanner.Text())
+				scanner.Scan()
+				assert.Equal(t, "READY", scanner.Text())
+			}
+
+			_, err = conn.Write([]byte("history /h/g\n"))
+			require.NoError(t, err)
+			scanner.Scan()
+			assert.Equal(t, "OK 4", scanner.Text())
+			for _, want := range []string{`^r1 2 `, `^DELETED `, `^r2 2 `, `^DELETED `} {
+				scanner.Scan()
+				assert.Regexp(t, want, scanner.Text())
+			}
+			scanner.Scan()
+			assert.Equal(t, "READY", scanner.Text())
+		})
+	})
+
 	// t.Run("crashy cases", func(t *testing.T) {
 	// 	conn, err := net.Dial("tcp", s.Addr)
 	// 	require.NoError(t, err)
@@ -281,3 +524,299 @@ func TestLevel10VoraciousCodeStorage(t *testing.T) {
 
 	// })
 }
+
+func TestLevel10VoraciousCodeStoragePersistence(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s, err := voraciouscodestorage.NewServer(ctx, "", voraciouscodestorage.WithDataDir(dir))
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	scanner := bufio.NewScanner(conn)
+	scanner.Scan()
+	require.Equal(t, "READY", scanner.Text())
+
+	for _, cmd := range []string{"put /a/b 5\nhello", "put /a/b 5\nworld", "put /../c 1\nx", "put /d 0\n", "delete /d\n", "put /index.log/e 1\ny"} {
+		_, err = conn.Write([]byte(cmd))
+		require.NoError(t, err)
+		scanner.Scan()
+		require.Contains(t, scanner.Text(), "OK")
+		scanner.Scan()
+		require.Equal(t, "READY", scanner.Text())
+	}
+	conn.Close()
+	require.NoError(t, s.Close())
+
+	// A crash mid-PUT leaves temporary files behind
+	stale := []string{filepath.Join(dir, ".spool-123"), filepath.Join(dir, "files", "a", ".tmp-456")}
+	for _, name := range stale {
+		require.NoError(t, os.WriteFile(name, []byte("partial"), 0o644))
+	}
+
+	// Restart on the same data directory, which clears them up
+	s, err = voraciouscodestorage.NewServer(ctx, "", voraciouscodestorage.WithDataDir(dir))
+	require.NoError(t, err)
+	defer s.Close()
+	for _, name := range stale {
+		_, err := os.Stat(name)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	}
+
+	conn, err = net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	scanner = bufio.NewScanner(conn)
+	scanner.Scan()
+	require.Equal(t, "READY", scanner.Text())
+
+	_, err = conn.Write([]byte("list /a\n"))
+	require.NoError(t, err)
+	scanner.Scan()
+	assert.Equal(t, "OK 1", scanner.Text())
+	scanner.Scan()
+	assert.Equal(t, "b r2", scanner.Text())
+	scanner.Scan()
+	assert.Equal(t, "READY", scanner.Text())
+
+	_, err = conn.Write([]byte("get /a/b r1\n"))
+	require.NoError(t, err)
+	scanner.Scan()
+	assert.Equal(t, "OK 5", scanner.Text())
+	scanner.Scan()
+	assert.Equal(t, "helloREADY", scanner.Text())
+
+	_, err = conn.Write([]byte("get /d\n"))
+	require.NoError(t, err)
+	scanner.Scan()
+	assert.Equal(t, "ERR file does not exist", scanner.Text())
+
+	_, err = conn.Write([]byte("get /../c\n"))
+	require.NoError(t, err)
+	scanner.Scan()
+	assert.Equal(t, "OK 1", scanner.Text())
+	scanner.Scan()
+	assert.Equal(t, "xREADY", scanner.Text())
+
+	_, err = conn.Write([]byte("get /index.log/e\n"))
+	require.NoError(t, err)
+	scanner.Scan()
+	assert.Equal(t, "OK 1", scanner.Text())
+	scanner.Scan()
+	assert.Equal(t, "yREADY", scanner.Text())
+
+	_, err = conn.Write([]byte("put /a/b 5\nworld"))
+	require.NoError(t, err)
+	scanner.Scan()
+	assert.Equal(t, "OK r2", scanner.Text())
+	scanner.Scan()
+	assert.Equal(t, "READY", scanner.Text())
+}
+
+func TestLevel10VoraciousCodeStorageLimits(t *testing.T) {
+	ctx := context.Background()
+	s, err := voraciouscodestorage.NewServer(ctx, "",
+		voraciouscodestorage.WithMaxFileSize(100),
+		voraciouscodestorage.WithSpoolThreshold(10))
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Scan()
+	require.Equal(t, "READY", scanner.Text())
+
+	data := strings.Repeat("0123456789", 5)
+
+	t.Run("spooled file", func(t *testing.T) {
+		_, err = conn.Write([]byte("put /big 50\n" + data))
+		require.NoError(t, err)
+		scanner.Scan()
+		assert.Equal(t, "OK r1", scanner.Text())
+		scanner.Scan()
+		assert.Equal(t, "READY", scanner.Text())
+
+		_, err = conn.Write([]byte("put /big 50\n" + data))
+		require.NoError(t, err)
+		scanner.Scan()
+		assert.Equal(t, "OK r1", scanner.Text())
+		scanner.Scan()
+		assert.Equal(t, "READY", scanner.Text())
+
+		_, err = conn.Write([]byte("get /big\n"))
+		require.NoError(t, err)
+		scanner.Scan()
+		assert.Equal(t, "OK 50", scanner.Text())
+		scanner.Scan()
+		assert.Equal(t, data+"READY", scanner.Text())
+	})
+
+	t.Run("diff of spooled files is refused", func(t *testing.T) {
+		_, err = conn.Write([]byte("put /big 50\n" + strings.Repeat("9876543210", 5)))
+		require.NoError(t, err)
+		scanner.Scan()
+		assert.Equal(t, "OK r2", scanner.Text())
+		scanner.Scan()
+		assert.Equal(t, "READY", scanner.Text())
+
+		_, err = conn.Write([]byte("diff /big r1 r2\n"))
+		require.NoError(t, err)
+		scanner.Scan()
+		assert.Equal(t, "ERR file too large to diff", scanner.Text())
+	})
+
+	t.Run("illegal content is drained", func(t *testing.T) {
+		_, err = conn.Write([]byte("put /bin 20\n\x00" + data[:19]))
+		require.NoError(t, err)
+		scanner.Scan()
+		assert.Equal(t, "ERR illegal file content", scanner.Text())
+
+		_, err = conn.Write([]byte("get /bin\n"))
+		require.NoError(t, err)
+		scanner.Scan()
+		assert.Equal(t, "ERR file does not exist", scanner.Text())
+	})
+
+	t.Run("file too large", func(t *testing.T) {
+		_, err = conn.Write([]byte("put /huge 2000000000\n"))
+		require.NoError(t, err)
+		scanner.Scan()
+		assert.Equal(t, "ERR file too large", scanner.Text())
+		assert.False(t, scanner.Scan())
+	})
+}
+
+func TestLevel10VoraciousCodeStorageGitExport(t *testing.T) {
+	ctx := context.Background()
+	s, err := voraciouscodestorage.NewServer(ctx, "")
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Scan()
+	require.Equal(t, "READY", scanner.Text())
+
+	for _, cmd := range []string{"put /a 2\nv1", "put /b/c 1\nx", "put /a 2\nv2", "delete /b/c\n"} {
+		_, err = conn.Write([]byte(cmd))
+		require.NoError(t, err)
+		scanner.Scan()
+		require.Contains(t, scanner.Text(), "OK")
+		scanner.Scan()
+		require.Equal(t, "READY", scanner.Text())
+	}
+
+	var stream bytes.Buffer
+	require.NoError(t, s.ExportGit(&stream))
+	assert.Contains(t, stream.String(), "M 100644 inline a\ndata 2\nv1\n")
+	assert.Contains(t, stream.String(), "M 100644 inline b/c\ndata 1\nx\n")
+	assert.Contains(t, stream.String(), "D b/c\n")
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	repo := t.TempDir()
+	require.NoError(t, exec.Command("git", "init", "-q", repo).Run())
+	cmd := exec.Command("git", "-C", repo, "fast-import", "--quiet")
+	cmd.Stdin = &stream
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	out, err = exec.Command("git", "-C", repo, "log", "--format=%s", "main").Output()
+	require.NoError(t, err)
+	assert.Equal(t, "DELETE /b/c\nPUT /a r2\nPUT /b/c r1\nPUT /a r1\n", string(out))
+
+	out, err = exec.Command("git", "-C", repo, "show", "main:a").Output()
+	require.NoError(t, err)
+	assert.Equal(t, "v2", string(out))
+}
+
+func TestLevel10VoraciousCodeStorageConcurrentPut(t *testing.T) {
+	t.Run("in memory", func(t *testing.T) {
+		testConcurrentPut(t)
+	})
+	t.Run("persistent", func(t *testing.T) {
+		testConcurrentPut(t, voraciouscodestorage.WithDataDir(t.TempDir()))
+	})
+}
+
+func testConcurrentPut(t *testing.T, opts ...voraciouscodestorage.Option) {
+	ctx := context.Background()
+	s, err := voraciouscodestorage.NewServer(ctx, "", opts...)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// put sends one PUT on a fresh connection and returns the reply
+	put := func(cmd string) string {
+		conn, err := net.Dial("tcp", s.Addr)
+		if err != nil {
+			return err.Error()
+		}
+		defer conn.Close()
+
+		scanner := bufio.NewScanner(conn)
+		scanner.Scan()
+		if _, err := conn.Write([]byte(cmd)); err != nil {
+			return err.Error()
+		}
+		scanner.Scan()
+		return scanner.Text()
+	}
+
+	const clients = 20
+
+	t.Run("same data is stored once", func(t *testing.T) {
+		replies := make(chan string, clients)
+		for i := 0; i < clients; i++ {
+			go func() { replies <- put("put /same 5\nhello") }()
+		}
+		for i := 0; i < clients; i++ {
+			assert.Equal(t, "OK r1", <-replies)
+		}
+	})
+
+	t.Run("conditional puts don't lose updates", func(t *testing.T) {
+		replies := make(chan string, clients)
+		for i := 0; i < clients; i++ {
+			i := i
+			go func() { replies <- put(fmt.Sprintf("put /cas 2 if-r0\n%02d", i)) }()
+		}
+		ok := 0
+		for i := 0; i < clients; i++ {
+			reply := <-replies
+			if reply == "OK r1" {
+				ok++
+			} else {
+				assert.Equal(t, "ERR conflict: latest revision is r1", reply)
+			}
+		}
+		assert.Equal(t, 1, ok)
+
+		assert.Equal(t, "OK r2", put("put /cas 2 if-r1\nzz"))
+		assert.Equal(t, "ERR conflict: latest revision is r2", put("put /cas 2 if-r1\nyy"))
+		assert.Equal(t, "ERR illegal revision", put("put /cas 2 r1\nyy"))
+	})
+
+	t.Run("illegal revision skips the data", func(t *testing.T) {
+		conn, err := net.Dial("tcp", s.Addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		scanner.Scan()
+		_, err = conn.Write([]byte("put /cas 4 if-rx\nabc\nhelp\n"))
+		require.NoError(t, err)
+		scanner.Scan()
+		assert.Equal(t, "ERR illegal revision", scanner.Text())
+		scanner.Scan()
+		assert.Equal(t, "OK usage: HELP|GET|PUT|LIST|HISTORY|DIFF|DELETE", scanner.Text())
+		scanner.Scan()
+		assert.Equal(t, "READY", scanner.Text())
+	})
+}
@@ -3,10 +3,16 @@ package tests
 import (
 	"bufio"
 	"context"
+	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	budgetchat "github.com/fanatic/protohackers/3_budgetchat"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -70,6 +76,476 @@ func TestLevel3BudgetChat(t *testing.T) {
 	})
 }
 
+func TestLevel3BudgetChatRooms(t *testing.T) {
+	ctx := context.Background()
+	s, err := budgetchat.NewServer(ctx, "")
+	require.NoError(t, err)
+	defer s.Close()
+
+	erin, err := New(s.Addr)
+	require.NoError(t, err)
+	defer erin.Close()
+	assert.Equal(t, "Welcome to budgetchat! What shall I call you?", erin.ReadMessage())
+	require.NoError(t, erin.SendMessage("erin"))
+	assert.Equal(t, "* The room is empty", erin.ReadMessage())
+
+	frank, err := New(s.Addr)
+	require.NoError(t, err)
+	defer frank.Close()
+	assert.Equal(t, "Welcome to budgetchat! What shall I call you?", frank.ReadMessage())
+	require.NoError(t, frank.SendMessage("frank"))
+	assert.Equal(t, "* The room contains: erin", frank.ReadMessage())
+	assert.Equal(t, "* frank has entered the room", erin.ReadMessage())
+
+	t.Run("join", func(t *testing.T) {
+		require.NoError(t, erin.SendMessage("/join games"))
+		assert.Equal(t, "* erin has left the room", frank.ReadMessage())
+		assert.Equal(t, "* The room is empty", erin.ReadMessage())
+
+		require.NoError(t, erin.SendMessage("/rooms"))
+		assert.Equal(t, "* Rooms: games (1), lobby (1)", erin.ReadMessage())
+
+		require.NoError(t, frank.SendMessage("/who"))
+		assert.Equal(t, "* lobby contains: frank", frank.ReadMessage())
+	})
+
+	t.Run("empty rooms are removed", func(t *testing.T) {
+		require.NoError(t, frank.SendMessage("/join games"))
+		assert.Equal(t, "* The room contains: erin", frank.ReadMessage())
+		assert.Equal(t, "* frank has entered the room", erin.ReadMessage())
+
+		require.NoError(t, erin.SendMessage("/rooms"))
+		assert.Equal(t, "* Rooms: games (2)", erin.ReadMessage())
+	})
+
+	t.Run("messages stay in the room", func(t *testing.T) {
+		require.NoError(t, frank.SendMessage("hi"))
+		assert.Equal(t, "[frank] hi", erin.ReadMessage())
+	})
+
+	t.Run("other slash lines are chat", func(t *testing.T) {
+		require.NoError(t, frank.SendMessage("/shrug"))
+		assert.Equal(t, "[frank] /shrug", erin.ReadMessage())
+		require.NoError(t, frank.SendMessage("/ usr/bin is full"))
+		assert.Equal(t, "[frank] / usr/bin is full", erin.ReadMessage())
+	})
+
+	t.Run("leave", func(t *testing.T) {
+		require.NoError(t, erin.SendMessage("/leave"))
+		assert.Equal(t, "* erin has left the room", frank.ReadMessage())
+		assert.Equal(t, "* You have left games", erin.ReadMessage())
+
+		require.NoError(t, erin.SendMessage("hello"))
+		assert.Equal(t, "* You are not in a room, /join one to chat", erin.ReadMessage())
+	})
+
+	t.Run("unknown command", func(t *testing.T) {
+		require.NoError(t, erin.SendMessage("/nope"))
+		assert.Equal(t, "* You are not in a room, /join one to chat", erin.ReadMessage())
+	})
+}
+
+func TestLevel3BudgetChatNames(t *testing.T) {
+	ctx := context.Background()
+	s, err := budgetchat.NewServer(ctx, "")
+	require.NoError(t, err)
+	defer s.Close()
+
+	gina, err := New(s.Addr)
+	require.NoError(t, err)
+	defer gina.Close()
+	assert.Equal(t, "Welcome to budgetchat! What shall I call you?", gina.ReadMessage())
+	require.NoError(t, gina.SendMessage("gina"))
+	assert.Equal(t, "* The room is empty", gina.ReadMessage())
+
+	hank, err := New(s.Addr)
+	require.NoError(t, err)
+	defer hank.Close()
+	assert.Equal(t, "Welcome to budgetchat! What shall I call you?", hank.ReadMessage())
+	require.NoError(t, hank.SendMessage("hank"))
+	assert.Equal(t, "* The room contains: gina", hank.ReadMessage())
+	assert.Equal(t, "* hank has entered the room", gina.ReadMessage())
+
+	t.Run("duplicate name", func(t *testing.T) {
+		impostor, err := New(s.Addr)
+		require.NoError(t, err)
+		defer impostor.Close()
+		assert.Equal(t, "Welcome to budgetchat! What shall I call you?", impostor.ReadMessage())
+		require.NoError(t, impostor.SendMessage("gina"))
+		assert.Equal(t, "Username gina is already taken", impostor.ReadMessage())
+	})
+
+	t.Run("private message", func(t *testing.T) {
+		ivy, err := New(s.Addr)
+		require.NoError(t, err)
+		defer ivy.Close()
+		assert.Equal(t, "Welcome to budgetchat! What shall I call you?", ivy.ReadMessage())
+		require.NoError(t, ivy.SendMessage("ivy"))
+		assert.Equal(t, "* The room contains: gina, hank", ivy.ReadMessage())
+		assert.Equal(t, "* ivy has entered the room", gina.ReadMessage())
+		assert.Equal(t, "* ivy has entered the room", hank.ReadMessage())
+
+		require.NoError(t, gina.SendMessage("/msg hank psst over here"))
+		assert.Equal(t, "[gina -> hank] psst over here", hank.ReadMessage())
+
+		// ivy only sees what is said after the private message
+		require.NoError(t, gina.SendMessage("hi all"))
+		assert.Equal(t, "[gina] hi all", ivy.ReadMessage())
+		assert.Equal(t, "[gina] hi all", hank.ReadMessage())
+
+		require.NoError(t, gina.SendMessage("/msg nobody hi"))
+		assert.Equal(t, "* No such user: nobody", gina.ReadMessage())
+
+		ivy.Close()
+		assert.Equal(t, "* ivy has left the room", gina.ReadMessage())
+		assert.Equal(t, "* ivy has left the room", hank.ReadMessage())
+	})
+
+	t.Run("nick", func(t *testing.T) {
+		require.NoError(t, hank.SendMessage("/nick gina"))
+		assert.Equal(t, "* Username gina is already taken", hank.ReadMessage())
+
+		require.NoError(t, hank.SendMessage("/nick henry"))
+		assert.Equal(t, "* You are now known as henry", hank.ReadMessage())
+		assert.Equal(t, "* hank is now known as henry", gina.ReadMessage())
+
+		require.NoError(t, gina.SendMessage("/who"))
+		assert.Equal(t, "* lobby contains: gina, henry", gina.ReadMessage())
+
+		require.NoError(t, gina.SendMessage("/msg henry hello henry"))
+		assert.Equal(t, "[gina -> henry] hello henry", hank.ReadMessage())
+
+		// the old name is free again
+		hank2, err := New(s.Addr)
+		require.NoError(t, err)
+		defer hank2.Close()
+		assert.Equal(t, "Welcome to budgetchat! What shall I call you?", hank2.ReadMessage())
+		require.NoError(t, hank2.SendMessage("hank"))
+		assert.Equal(t, "* The room contains: gina, henry", hank2.ReadMessage())
+	})
+}
+
+func TestLevel3BudgetChatSlowReader(t *testing.T) {
+	ctx := context.Background()
+	s, err := budgetchat.NewServer(ctx, "")
+	require.NoError(t, err)
+	defer s.Close()
+
+	// stalled joins the room and then never reads again
+	stalled, err := net.Dial("tcp", s.Addr)
+	require.NoError(t, err)
+	defer stalled.Close()
+	_, err = stalled.Write([]byte("stalled\n"))
+	require.NoError(t, err)
+
+	sender, err := New(s.Addr)
+	require.NoError(t, err)
+	defer sender.Close()
+	assert.Equal(t, "Welcome to budgetchat! What shall I call you?", sender.ReadMessage())
+	require.NoError(t, sender.SendMessage("sender"))
+	assert.Equal(t, "* The room contains: stalled", sender.ReadMessage())
+
+	receiver, err := New(s.Addr)
+	require.NoError(t, err)
+	defer receiver.Close()
+	assert.Equal(t, "Welcome to budgetchat! What shall I call you?", receiver.ReadMessage())
+	require.NoError(t, receiver.SendMessage("receiver"))
+	assert.Equal(t, "* The room contains: stalled, sender", receiver.ReadMessage())
+	assert.Equal(t, "* receiver has entered the room", sender.ReadMessage())
+
+	// Far more than the stalled client's socket buffers and queue can hold.
+	// Each message must reach the receiver promptly even once they are full.
+	msg := strings.Repeat("x", 1000)
+	left := false
+	for i := 0; i < 10000; i++ {
+		require.NoError(t, sender.SendMessage(msg))
+
+		for delivered := false; !delivered; {
+			select {
+			case m := <-receiver.msgs:
+				if m == "* stalled has left the room" {
+					left = true
+					continue
+				}
+				require.Equal(t, "[sender] "+msg, m)
+				delivered = true
+			case <-time.After(time.Second):
+				t.Fatalf("message %d was not delivered", i)
+			}
+		}
+	}
+	assert.True(t, left, "stalled client should have been disconnected")
+}
+
+func TestLevel3BudgetChatHistory(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := budgetchat.NewServer(ctx, "", budgetchat.WithHistory(2), budgetchat.WithTranscriptDir(dir))
+	require.NoError(t, err)
+	defer s.Close()
+
+	jack, err := New(s.Addr)
+	require.NoError(t, err)
+	defer jack.Close()
+	assert.Equal(t, "Welcome to budgetchat! What shall I call you?", jack.ReadMessage())
+	require.NoError(t, jack.SendMessage("jack"))
+	assert.Equal(t, "* The room is empty", jack.ReadMessage())
+
+	kim, err := New(s.Addr)
+	require.NoError(t, err)
+	defer kim.Close()
+	assert.Equal(t, "Welcome to budgetchat! What shall I call you?", kim.ReadMessage())
+	require.NoError(t, kim.SendMessage("kim"))
+	assert.Equal(t, "* The room contains: jack", kim.ReadMessage())
+	assert.Equal(t, "* kim has entered the room", jack.ReadMessage())
+
+	for _, msg := range []string{"one", "two", "three"} {
+		require.NoError(t, jack.SendMessage(msg))
+		assert.Equal(t, "[jack] "+msg, kim.ReadMessage())
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		lee, err := New(s.Addr)
+		require.NoError(t, err)
+		defer lee.Close()
+		assert.Equal(t, "Welcome to budgetchat! What shall I call you?", lee.ReadMessage())
+		require.NoError(t, lee.SendMessage("lee"))
+		assert.Equal(t, "* The room contains: jack, kim", lee.ReadMessage())
+		assert.Equal(t, "* Replaying the last 2 messages:", lee.ReadMessage())
+		assert.Equal(t, "[jack] two", lee.ReadMessage())
+		assert.Equal(t, "[jack] three", lee.ReadMessage())
+		assert.Equal(t, "* End of replay", lee.ReadMessage())
+
+		require.NoError(t, kim.SendMessage("hi lee"))
+		assert.Equal(t, "[kim] hi lee", lee.ReadMessage())
+	})
+
+	t.Run("transcript", func(t *testing.T) {
+		transcript, err := os.ReadFile(filepath.Join(dir, "lobby.log"))
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(transcript)), "\n")
+		require.Len(t, lines, 7)
+		assert.Regexp(t, `^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ \* jack has entered the room$`, lines[0])
+		assert.Regexp(t, `Z \[jack\] one$`, lines[2])
+		assert.Regexp(t, `Z \[kim\] hi lee$`, lines[6])
+	})
+}
+
+func TestLevel3BudgetChatLongHistory(t *testing.T) {
+	ctx := context.Background()
+	n := 2 * budgetchat.OutboundQueueSize
+	s, err := budgetchat.NewServer(ctx, "", budgetchat.WithHistory(n))
+	require.NoError(t, err)
+	defer s.Close()
+
+	mia, err := New(s.Addr)
+	require.NoError(t, err)
+	defer mia.Close()
+	assert.Equal(t, "Welcome to budgetchat! What shall I call you?", mia.ReadMessage())
+	require.NoError(t, mia.SendMessage("mia"))
+	assert.Equal(t, "* The room is empty", mia.ReadMessage())
+	for i := 0; i < n; i++ {
+		require.NoError(t, mia.SendMessage(fmt.Sprint(i)))
+	}
+	require.NoError(t, mia.SendMessage("/who"))
+	assert.Equal(t, "* lobby contains: mia", mia.ReadMessage())
+
+	// More history than fits in the joiner's queue is still replayed in full
+	ned, err := New(s.Addr)
+	require.NoError(t, err)
+	defer ned.Close()
+	assert.Equal(t, "Welcome to budgetchat! What shall I call you?", ned.ReadMessage())
+	require.NoError(t, ned.SendMessage("ned"))
+	assert.Equal(t, "* The room contains: mia", ned.ReadMessage())
+	assert.Equal(t, fmt.Sprintf("* Replaying the last %d messages:", n), ned.ReadMessage())
+	for i := 0; i < n; i++ {
+		require.Equal(t, fmt.Sprintf("[mia] %d", i), ned.ReadMessage())
+	}
+	assert.Equal(t, "* End of replay", ned.ReadMessage())
+
+	require.NoError(t, mia.SendMessage("hi ned"))
+	assert.Equal(t, "[mia] hi ned", ned.ReadMessage())
+}
+
+func TestLevel3BudgetChatWebSocket(t *testing.T) {
+	ctx := context.Background()
+	s, err := budgetchat.NewServer(ctx, "", budgetchat.WithWebSocket("127.0.0.1:0"))
+	require.NoError(t, err)
+	defer s.Close()
+
+	alice, err := New(s.Addr)
+	require.NoError(t, err)
+	defer alice.Close()
+	assert.Equal(t, "Welcome to budgetchat! What shall I call you?", alice.ReadMessage())
+	require.NoError(t, alice.SendMessage("alice"))
+	assert.Equal(t, "* The room is empty", alice.ReadMessage())
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+s.WSAddr+"/", nil)
+	require.NoError(t, err)
+	defer ws.Close()
+	readWS := func() string {
+		_, msg, err := ws.ReadMessage()
+		require.NoError(t, err)
+		return string(msg)
+	}
+	assert.Equal(t, "Welcome to budgetchat! What shall I call you?", readWS())
+	require.NoError(t, ws.WriteMessage(websocket.TextMessage, []byte("bob")))
+	assert.Equal(t, "* The room contains: alice", readWS())
+	assert.Equal(t, "* bob has entered the room", alice.ReadMessage())
+
+	require.NoError(t, ws.WriteMessage(websocket.TextMessage, []byte("hi from the web")))
+	assert.Equal(t, "[bob] hi from the web", alice.ReadMessage())
+
+	require.NoError(t, alice.SendMessage("hi from tcp"))
+	assert.Equal(t, "[alice] hi from tcp", readWS())
+
+	t.Run("names are shared", func(t *testing.T) {
+		dup, _, err := websocket.DefaultDialer.Dial("ws://"+s.WSAddr+"/", nil)
+		require.NoError(t, err)
+		defer dup.Close()
+		_, _, err = dup.ReadMessage()
+		require.NoError(t, err)
+		require.NoError(t, dup.WriteMessage(websocket.TextMessage, []byte("alice")))
+		_, msg, err := dup.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "Username alice is already taken", string(msg))
+		_, _, err = dup.ReadMessage()
+		assert.Error(t, err)
+	})
+
+	ws.Close()
+	assert.Equal(t, "* bob has left the room", alice.ReadMessage())
+}
+
+func TestLevel3BudgetChatWebSocketClose(t *testing.T) {
+	ctx := context.Background()
+	s, err := budgetchat.NewServer(ctx, "", budgetchat.WithWebSocket("127.0.0.1:0"))
+	require.NoError(t, err)
+
+	// Clients still arriving while the server closes
+	stop := make(chan struct{})
+	dialed := make(chan struct{})
+	go func() {
+		defer close(dialed)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if ws, _, err := websocket.DefaultDialer.Dial("ws://"+s.WSAddr+"/", nil); err == nil {
+				ws.Close()
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close did not return")
+	}
+	close(stop)
+	<-dialed
+
+	_, _, err = websocket.DefaultDialer.Dial("ws://"+s.WSAddr+"/", nil)
+	assert.Error(t, err)
+}
+
+func TestLevel3BudgetChatModeration(t *testing.T) {
+	ctx := context.Background()
+	s, err := budgetchat.NewServer(ctx, "",
+		budgetchat.WithMaxMessageLength(20),
+		budgetchat.WithRateLimit(0.001, 8),
+		budgetchat.WithModerator(budgetchat.NewWordFilter("darn", "heck")),
+		budgetchat.WithOperatorPassword("hunter2"),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	join := func(name string) *ChatClient {
+		c, err := New(s.Addr)
+		require.NoError(t, err)
+		assert.Equal(t, "Welcome to budgetchat! What shall I call you?", c.ReadMessage())
+		require.NoError(t, c.SendMessage(name))
+		c.ReadMessage()
+		return c
+	}
+
+	op := join("op")
+	defer op.Close()
+
+	t.Run("word filter", func(t *testing.T) {
+		bob := join("bob")
+		defer bob.Close()
+		assert.Equal(t, "* bob has entered the room", op.ReadMessage())
+
+		require.NoError(t, bob.SendMessage("oh Darn it"))
+		assert.Equal(t, "[bob] oh **** it", op.ReadMessage())
+		require.NoError(t, bob.SendMessage("darned heckler"))
+		assert.Equal(t, "[bob] darned heckler", op.ReadMessage())
+
+		bob.Close()
+		assert.Equal(t, "* bob has left the room", op.ReadMessage())
+	})
+
+	t.Run("max length", func(t *testing.T) {
+		carl := join("carl")
+		defer carl.Close()
+		assert.Equal(t, "* carl has entered the room", op.ReadMessage())
+
+		require.NoError(t, carl.SendMessage(strings.Repeat("a", 20)))
+		assert.Equal(t, "[carl] "+strings.Repeat("a", 20), op.ReadMessage())
+		require.NoError(t, carl.SendMessage(strings.Repeat("a", 21)))
+		assert.Equal(t, "Message too long, the limit is 20 characters", carl.ReadMessage())
+		assert.Equal(t, "* carl has left the room", op.ReadMessage())
+	})
+
+	t.Run("rate limit", func(t *testing.T) {
+		dan := join("dan")
+		defer dan.Close()
+		assert.Equal(t, "* dan has entered the room", op.ReadMessage())
+
+		for i := 0; i < 8; i++ {
+			require.NoError(t, dan.SendMessage("spam"))
+			assert.Equal(t, "[dan] spam", op.ReadMessage())
+		}
+		require.NoError(t, dan.SendMessage("spam"))
+		assert.Equal(t, "* Slow down, you are sending messages too fast", dan.ReadMessage())
+		require.NoError(t, dan.SendMessage("/msg op spam"))
+		assert.Equal(t, "* Slow down, you are sending messages too fast", dan.ReadMessage())
+
+		// Other commands aren't limited
+		require.NoError(t, dan.SendMessage("/who"))
+		assert.Equal(t, "* lobby contains: op, dan", dan.ReadMessage())
+
+		dan.Close()
+		assert.Equal(t, "* dan has left the room", op.ReadMessage())
+	})
+
+	t.Run("kick", func(t *testing.T) {
+		eve := join("eve")
+		defer eve.Close()
+		assert.Equal(t, "* eve has entered the room", op.ReadMessage())
+
+		require.NoError(t, eve.SendMessage("/kick op"))
+		assert.Equal(t, "* Permission denied", eve.ReadMessage())
+		require.NoError(t, op.SendMessage("/oper wrong"))
+		assert.Equal(t, "* Permission denied", op.ReadMessage())
+
+		require.NoError(t, op.SendMessage("/oper hunter2"))
+		assert.Equal(t, "* You are now an operator", op.ReadMessage())
+		require.NoError(t, op.SendMessage("/kick eve"))
+		assert.Equal(t, "You have been kicked by op", eve.ReadMessage())
+		assert.ElementsMatch(t, []string{"* Kicked eve", "* eve has left the room"}, []string{op.ReadMessage(), op.ReadMessage()})
+	})
+}
+
 type ChatClient struct {
 	c    net.Conn
 	msgs chan string
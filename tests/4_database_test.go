@@ -2,7 +2,13 @@ package tests
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -75,3 +81,417 @@ func TestLevel4UnusualDatabaseProgram(t *testing.T) {
 		assert.Equal(t, "color=", string(received[:n]))
 	})
 }
+
+func TestLevel4UnusualDatabasePersistence(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	query := func(t *testing.T, s *database.Server, packets ...string) []string {
+		conn, err := net.Dial("udp", s.Addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		var responses []string
+		received := make([]byte, 1000)
+		for _, p := range packets {
+			_, err = conn.Write([]byte(p))
+			require.NoError(t, err)
+			if strings.Contains(p, "=") {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+			n, err := conn.Read(received)
+			require.NoError(t, err)
+			responses = append(responses, string(received[:n]))
+		}
+		return responses
+	}
+
+	t.Run("snapshot and log", func(t *testing.T) {
+		s, err := database.NewServer(ctx, "127.0.0.1:0", database.WithDataDir(dir), database.WithSnapshotInterval(20*time.Millisecond))
+		require.NoError(t, err)
+		query(t, s, "color=blue", "multi=line\nvalue", "version=hacked")
+
+		// Wait for a snapshot, then log some more on top of it
+		require.Eventually(t, func() bool {
+			b, err := os.ReadFile(filepath.Join(dir, "snapshot"))
+			return err == nil && strings.Contains(string(b), "color")
+		}, time.Second, 10*time.Millisecond)
+		query(t, s, "color=green", "empty=")
+		require.NoError(t, s.Close())
+	})
+
+	t.Run("torn log", func(t *testing.T) {
+		f, err := os.OpenFile(filepath.Join(dir, "inserts.log"), os.O_WRONLY|os.O_APPEND, 0o644)
+		require.NoError(t, err)
+		_, err = f.WriteString(`"torn" "val`)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	})
+
+	t.Run("recover", func(t *testing.T) {
+		s, err := database.NewServer(ctx, "127.0.0.1:0", database.WithDataDir(dir), database.WithSnapshotInterval(0))
+		require.NoError(t, err)
+		assert.Equal(t,
+			[]string{"color=green", "multi=line\nvalue", "empty=", "torn=", "version=fanatic/protohackers"},
+			query(t, s, "color", "multi", "empty", "torn", "version", "after=restart"))
+		require.NoError(t, s.Close())
+
+		s, err = database.NewServer(ctx, "127.0.0.1:0", database.WithDataDir(dir))
+		require.NoError(t, err)
+		defer s.Close()
+		assert.Equal(t, []string{"after=restart", "color=green"}, query(t, s, "after", "color"))
+	})
+
+	t.Run("crash while snapshotting", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "snapshot"), []byte("\"a\" \"1\"\n\"b\" \"1\"\n"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "inserts.log.old"), []byte("\"b\" \"2\"\n\"c\" \"2\"\n"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "inserts.log"), []byte("\"c\" \"3\"\n"), 0o644))
+
+		s, err := database.NewServer(ctx, "127.0.0.1:0", database.WithDataDir(dir), database.WithSnapshotInterval(0))
+		require.NoError(t, err)
+		defer s.Close()
+		assert.Equal(t, []string{"a=1", "b=2", "c=3"}, query(t, s, "a", "b", "c"))
+		_, err = os.Stat(filepath.Join(dir, "inserts.log.old"))
+		assert.True(t, os.IsNotExist(err), "old log should be folded into the snapshot")
+	})
+}
+
+func TestLevel4UnusualDatabaseConcurrentInserts(t *testing.T) {
+	ctx := context.Background()
+	s, err := database.NewServer(ctx, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer s.Close()
+
+	const clients, keys = 20, 100
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		c := c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("udp", s.Addr)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+
+			// Long keys and values make any overlap between packets show
+			kv := func(k int) (string, string) {
+				return fmt.Sprintf("client%d-key%d-%s", c, k, strings.Repeat("k", 100)),
+					fmt.Sprintf("client%d-value%d-%s", c, k, strings.Repeat("v", 300))
+			}
+
+			// Fire every insert at once
+			for k := 0; k < keys; k++ {
+				key, value := kv(k)
+				conn.Write([]byte(key + "=" + value))
+			}
+
+			// Then check each, re-inserting any the network dropped
+			received := make([]byte, 1000)
+			for k := 0; k < keys; k++ {
+				key, value := kv(k)
+				for attempt := 0; ; attempt++ {
+					if !assert.Less(t, attempt, 50, "key %q never arrived", key) {
+						return
+					}
+					conn.Write([]byte(key))
+					conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+					n, err := conn.Read(received)
+					if err != nil {
+						continue
+					}
+					got := string(received[:n])
+					if got == key+"="+value {
+						break
+					}
+					if strings.HasPrefix(got, key+"=") && got != key+"=" {
+						t.Errorf("corrupt value for %q: %q", key, got)
+						return
+					}
+					conn.Write([]byte(key + "=" + value))
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestLevel4UnusualDatabaseReplication(t *testing.T) {
+	ctx := context.Background()
+
+	retrieve := func(s *database.Server, key string) string {
+		conn, err := net.Dial("udp", s.Addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte(key))
+		require.NoError(t, err)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		received := make([]byte, 1000)
+		n, err := conn.Read(received)
+		require.NoError(t, err)
+		return string(received[:n])
+	}
+	insert := func(s *database.Server, key, value string) {
+		conn, err := net.Dial("udp", s.Addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte(key + "=" + value))
+		require.NoError(t, err)
+	}
+	converged := func(nodes []*database.Server, key, want string) {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			for _, s := range nodes {
+				if retrieve(s, key) != key+"="+want {
+					return false
+				}
+			}
+			return true
+		}, 5*time.Second, 20*time.Millisecond, "nodes never agreed on %s=%s", key, want)
+	}
+
+	a, err := database.NewServer(ctx, "127.0.0.1:0", database.WithReplication("127.0.0.1:0"))
+	require.NoError(t, err)
+	defer a.Close()
+	insert(a, "before", "joining")
+	converged([]*database.Server{a}, "before", "joining")
+
+	// b and c join, syncing what a already has
+	b, err := database.NewServer(ctx, "127.0.0.1:0", database.WithReplication("127.0.0.1:0", a.PeerAddr))
+	require.NoError(t, err)
+	defer b.Close()
+	a.AddPeer(b.PeerAddr)
+	c, err := database.NewServer(ctx, "127.0.0.1:0", database.WithReplication("127.0.0.1:0", a.PeerAddr, b.PeerAddr))
+	require.NoError(t, err)
+	defer c.Close()
+	a.AddPeer(c.PeerAddr)
+	b.AddPeer(c.PeerAddr)
+
+	nodes := []*database.Server{a, b, c}
+	converged(nodes, "before", "joining")
+
+	t.Run("inserts to different nodes", func(t *testing.T) {
+		insert(a, "x", "from a")
+		insert(b, "y", "from b")
+		insert(c, "z", "from c")
+		converged(nodes, "x", "from a")
+		converged(nodes, "y", "from b")
+		converged(nodes, "z", "from c")
+	})
+
+	t.Run("last writer wins", func(t *testing.T) {
+		insert(a, "color", "red")
+		converged(nodes, "color", "red")
+		insert(c, "color", "blue")
+		converged(nodes, "color", "blue")
+
+		// Racing writes settle on the same value everywhere
+		for i := 0; i < 20; i++ {
+			insert(nodes[i%3], "race", fmt.Sprint(i))
+		}
+		require.Eventually(t, func() bool {
+			v := retrieve(a, "race")
+			return v == retrieve(b, "race") && v == retrieve(c, "race")
+		}, 5*time.Second, 20*time.Millisecond)
+	})
+
+	t.Run("version is local", func(t *testing.T) {
+		insert(a, "version", "hacked")
+		for _, s := range nodes {
+			assert.Equal(t, "version=fanatic/protohackers", retrieve(s, "version"))
+		}
+	})
+}
+
+func TestLevel4UnusualDatabaseReplicationRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	retrieve := func(s *database.Server, key string) string {
+		conn, err := net.Dial("udp", s.Addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte(key))
+		require.NoError(t, err)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		received := make([]byte, 1000)
+		n, err := conn.Read(received)
+		require.NoError(t, err)
+		return string(received[:n])
+	}
+	insert := func(s *database.Server, key, value string) {
+		conn, err := net.Dial("udp", s.Addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte(key + "=" + value))
+		require.NoError(t, err)
+		require.Eventually(t, func() bool { return retrieve(s, key) == key+"="+value }, time.Second, 10*time.Millisecond)
+	}
+
+	// b writes first, then a, which restarts before they meet
+	b, err := database.NewServer(ctx, "127.0.0.1:0", database.WithReplication("127.0.0.1:0"))
+	require.NoError(t, err)
+	defer b.Close()
+	insert(b, "k", "older")
+
+	a, err := database.NewServer(ctx, "127.0.0.1:0", database.WithDataDir(dir), database.WithReplication("127.0.0.1:0"))
+	require.NoError(t, err)
+	insert(a, "k", "newer")
+	require.NoError(t, a.Close())
+
+	a, err = database.NewServer(ctx, "127.0.0.1:0", database.WithDataDir(dir), database.WithReplication("127.0.0.1:0", b.PeerAddr))
+	require.NoError(t, err)
+	defer a.Close()
+	b.AddPeer(a.PeerAddr)
+
+	// a's write still wins, having kept the time it was made
+	require.Eventually(t, func() bool {
+		return retrieve(a, "k") == "k=newer" && retrieve(b, "k") == "k=newer"
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestLevel4UnusualDatabaseExtensions(t *testing.T) {
+	ctx := context.Background()
+	s, err := database.NewServer(ctx, "127.0.0.1:0", database.WithExtensions())
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("udp", s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// request asks for each page of the response to p in turn, checking
+	// every one comes back in a single datagram
+	request := func(p string) []string {
+		var pages []string
+		received := make([]byte, 2000)
+		for page, total := 1, 1; page <= total; page++ {
+			ask := p
+			if page > 1 {
+				ask = fmt.Sprintf("%s@%d", p, page)
+			}
+			_, err := conn.Write([]byte(ask))
+			require.NoError(t, err)
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+			n, err := conn.Read(received)
+			require.NoError(t, err)
+			assert.Less(t, n, 1000)
+
+			header, payload, _ := strings.Cut(strings.TrimPrefix(string(received[:n]), ask+"="), "\n")
+			var got int
+			_, err = fmt.Sscanf(header, "%d/%d", &got, &total)
+			require.NoError(t, err)
+			require.Equal(t, page, got)
+			pages = append(pages, payload)
+		}
+
+		// Nothing more arrives unasked
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+		_, err := conn.Read(received)
+		require.Error(t, err)
+		require.NoError(t, conn.SetReadDeadline(time.Time{}))
+		return pages
+	}
+
+	var want []string
+	for i := 0; i < 60; i++ {
+		key := fmt.Sprintf("user:%02d:%s", i, strings.Repeat("x", 30))
+		want = append(want, strconv.Quote(key))
+		_, err = conn.Write([]byte(key + "=" + fmt.Sprint(i)))
+		require.NoError(t, err)
+	}
+	_, err = conn.Write([]byte("other=value"))
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	t.Run("keys with prefix", func(t *testing.T) {
+		pages := request("\x00keys:user:")
+		assert.Greater(t, len(pages), 1)
+		assert.Equal(t, strings.Join(want, "\n")+"\n", strings.Join(pages, ""))
+	})
+
+	t.Run("all keys", func(t *testing.T) {
+		keys := strings.Split(strings.TrimSuffix(strings.Join(request("\x00keys"), ""), "\n"), "\n")
+		assert.Len(t, keys, 62)
+		assert.Contains(t, keys, `"version"`)
+		assert.Contains(t, keys, `"other"`)
+	})
+
+	t.Run("no keys", func(t *testing.T) {
+		assert.Equal(t, []string{""}, request("\x00keys:missing"))
+	})
+
+	t.Run("page out of range", func(t *testing.T) {
+		_, err := conn.Write([]byte("\x00keys:user:@99"))
+		require.NoError(t, err)
+		received := make([]byte, 1000)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		n, err := conn.Read(received)
+		require.NoError(t, err)
+		assert.Equal(t, "\x00keys:user:@99=", string(received[:n]))
+	})
+
+	t.Run("large value", func(t *testing.T) {
+		value := strings.Repeat("0123456789", 99)
+		_, err = conn.Write([]byte("big=" + value))
+		require.NoError(t, err)
+		time.Sleep(10 * time.Millisecond)
+
+		pages := request("\x00value:big")
+		assert.Len(t, pages, 2)
+		assert.Equal(t, value, strings.Join(pages, ""))
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		_, err := conn.Write([]byte("\x00stats"))
+		require.NoError(t, err)
+		received := make([]byte, 1000)
+		n, err := conn.Read(received)
+		require.NoError(t, err)
+		assert.Regexp(t, "^\x00stats=entries=63 bytes=\\d+ heap=\\d+$", string(received[:n]))
+		first := string(received[:n])
+
+		// Stats are worked out at most once a second, however often asked
+		_, err = conn.Write([]byte("another=key"))
+		require.NoError(t, err)
+		time.Sleep(10 * time.Millisecond)
+		_, err = conn.Write([]byte("\x00stats"))
+		require.NoError(t, err)
+		n, err = conn.Read(received)
+		require.NoError(t, err)
+		assert.Equal(t, first, string(received[:n]))
+	})
+
+	t.Run("reserved keys", func(t *testing.T) {
+		_, err := conn.Write([]byte("\x00stats=hacked"))
+		require.NoError(t, err)
+		time.Sleep(10 * time.Millisecond)
+		_, err = conn.Write([]byte("\x00unknown"))
+		require.NoError(t, err)
+		received := make([]byte, 1000)
+		n, err := conn.Read(received)
+		require.NoError(t, err)
+		assert.Equal(t, "\x00unknown=", string(received[:n]))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		plain, err := database.NewServer(ctx, "127.0.0.1:0")
+		require.NoError(t, err)
+		defer plain.Close()
+		conn, err := net.Dial("udp", plain.Addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("\x00keys"))
+		require.NoError(t, err)
+		received := make([]byte, 1000)
+		n, err := conn.Read(received)
+		require.NoError(t, err)
+		assert.Equal(t, "\x00keys=", string(received[:n]))
+	})
+}
@@ -2,19 +2,22 @@ package tests
 
 import (
 	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	budgetchat "github.com/fanatic/protohackers/3_budgetchat"
 	mobinthemiddle "github.com/fanatic/protohackers/5_mobinthemiddle"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestLevel5MobInTheMiddle(t *testing.T) {
-	ctx := context.Background()
-	s, err := mobinthemiddle.NewServer(ctx, "")
-	require.NoError(t, err)
-	defer s.Close()
-
 	tests := []struct {
 		input string
 		want  string
@@ -27,9 +30,227 @@ func TestLevel5MobInTheMiddle(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run("rewrite", func(t *testing.T) {
-			got, _ := s.Boguscoin.Replace(tc.input, "MATCH", -1, -1)
+			got := mobinthemiddle.RewriteBoguscoin(tc.input, "MATCH")
 
 			assert.Equal(t, tc.want, got)
 		})
 	}
 }
+
+func TestLevel5MobInTheMiddleProxy(t *testing.T) {
+	ctx := context.Background()
+	upstream, err := budgetchat.NewServer(ctx, "")
+	require.NoError(t, err)
+	defer upstream.Close()
+
+	join := func(addr, name string) *ChatClient {
+		c, err := New(addr)
+		require.NoError(t, err)
+		assert.Equal(t, "Welcome to budgetchat! What shall I call you?", c.ReadMessage())
+		require.NoError(t, c.SendMessage(name))
+		c.ReadMessage()
+		return c
+	}
+
+	t.Run("default rules", func(t *testing.T) {
+		s, err := mobinthemiddle.NewServer(ctx, "", mobinthemiddle.WithUpstream(upstream.Addr))
+		require.NoError(t, err)
+		defer s.Close()
+
+		bob := join(upstream.Addr, "bob")
+		defer bob.Close()
+		alice := join(s.Addr, "alice")
+		defer alice.Close()
+		assert.Equal(t, "* alice has entered the room", bob.ReadMessage())
+
+		require.NoError(t, alice.SendMessage("send to 7F1u3wSD5RbOHQmupo9nx4TnhQ please"))
+		assert.Equal(t, "[alice] send to "+mobinthemiddle.TonyAddress+" please", bob.ReadMessage())
+
+		require.NoError(t, bob.SendMessage("mine is 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX"))
+		assert.Equal(t, "[bob] mine is "+mobinthemiddle.TonyAddress, alice.ReadMessage())
+	})
+
+	t.Run("rules file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "rules.json")
+		require.NoError(t, os.WriteFile(path, []byte(`[
+			{"pattern": "cat", "replacement": "dog", "direction": "client-to-server"},
+			{"pattern": "dog", "replacement": "wolf", "direction": "client-to-server"},
+			{"pattern": "\\bhi\\b", "replacement": "hello", "direction": "server-to-client"}
+		]`), 0o644))
+		rules, err := mobinthemiddle.LoadRules(path)
+		require.NoError(t, err)
+		require.Len(t, rules, 3)
+
+		s, err := mobinthemiddle.NewServer(ctx, "", mobinthemiddle.WithUpstream(upstream.Addr), mobinthemiddle.WithRules(rules...))
+		require.NoError(t, err)
+		defer s.Close()
+
+		carol := join(upstream.Addr, "carol")
+		defer carol.Close()
+		dave := join(s.Addr, "dave")
+		defer dave.Close()
+		assert.Equal(t, "* dave has entered the room", carol.ReadMessage())
+
+		// Rules apply in order, so cat becomes dog becomes wolf
+		require.NoError(t, dave.SendMessage("my cat says hi"))
+		assert.Equal(t, "[dave] my wolf says hi", carol.ReadMessage())
+
+		require.NoError(t, carol.SendMessage("hi there cat"))
+		assert.Equal(t, "[carol] hello there cat", dave.ReadMessage())
+	})
+
+	t.Run("bad rules file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "rules.json")
+		require.NoError(t, os.WriteFile(path, []byte(`[{"pattern": "x", "direction": "sideways"}]`), 0o644))
+		_, err := mobinthemiddle.LoadRules(path)
+		assert.Error(t, err)
+
+		// RE2 can't do lookaround, so it's refused up front
+		require.NoError(t, os.WriteFile(path, []byte(`[{"pattern": "says(?= hi)", "replacement": "whispers"}]`), 0o644))
+		_, err = mobinthemiddle.LoadRules(path)
+		assert.ErrorContains(t, err, "lookaround")
+	})
+}
+
+func TestLevel5MobInTheMiddleUpstreamFailures(t *testing.T) {
+	ctx := context.Background()
+	upstream, err := budgetchat.NewServer(ctx, "")
+	require.NoError(t, err)
+	defer upstream.Close()
+
+	// failFirst fails the first n dials, then connects to the real upstream
+	failFirst := func(n int32, attempts *int32) func(context.Context, string, string) (net.Conn, error) {
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if atomic.AddInt32(attempts, 1) <= n {
+				return nil, errors.New("connection refused")
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, upstream.Addr)
+		}
+	}
+
+	t.Run("error line", func(t *testing.T) {
+		var attempts int32
+		s, err := mobinthemiddle.NewServer(ctx, "",
+			mobinthemiddle.WithDialContext(failFirst(100, &attempts)),
+			mobinthemiddle.WithDialRetry(3, time.Millisecond),
+			mobinthemiddle.WithUpstreamErrorMessage("* Upstream unavailable, try again later"),
+		)
+		require.NoError(t, err)
+		defer s.Close()
+
+		c, err := net.Dial("tcp", s.Addr)
+		require.NoError(t, err)
+		defer c.Close()
+		got, err := io.ReadAll(c)
+		require.NoError(t, err)
+		assert.Equal(t, "* Upstream unavailable, try again later\n", string(got))
+		assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		var attempts int32
+		s, err := mobinthemiddle.NewServer(ctx, "",
+			mobinthemiddle.WithDialContext(failFirst(2, &attempts)),
+			mobinthemiddle.WithDialRetry(3, time.Millisecond),
+		)
+		require.NoError(t, err)
+		defer s.Close()
+
+		alice, err := New(s.Addr)
+		require.NoError(t, err)
+		defer alice.Close()
+
+		// The third attempt reaches the upstream
+		assert.Equal(t, "Welcome to budgetchat! What shall I call you?", alice.ReadMessage())
+		assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+	})
+
+	t.Run("pool", func(t *testing.T) {
+		dialed := make(chan struct{}, 10)
+		dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed <- struct{}{}
+			var d net.Dialer
+			return d.DialContext(ctx, network, upstream.Addr)
+		}
+		s, err := mobinthemiddle.NewServer(ctx, "",
+			mobinthemiddle.WithDialContext(dial),
+			mobinthemiddle.WithUpstreamPool(2),
+		)
+		require.NoError(t, err)
+		defer s.Close()
+
+		// The pool fills up ahead of any client
+		<-dialed
+		<-dialed
+
+		alice, err := New(s.Addr)
+		require.NoError(t, err)
+		defer alice.Close()
+		assert.Equal(t, "Welcome to budgetchat! What shall I call you?", alice.ReadMessage())
+
+		// Taking a connection refills the pool, and only then
+		<-dialed
+		assert.Len(t, dialed, 0)
+	})
+}
+
+func TestLevel5MobInTheMiddleSessions(t *testing.T) {
+	ctx := context.Background()
+	upstream, err := budgetchat.NewServer(ctx, "")
+	require.NoError(t, err)
+	defer upstream.Close()
+
+	stats := make(chan mobinthemiddle.SessionStats, 1)
+	s, err := mobinthemiddle.NewServer(ctx, "",
+		mobinthemiddle.WithUpstream(upstream.Addr),
+		mobinthemiddle.WithSessionStats(func(st mobinthemiddle.SessionStats) { stats <- st }),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	t.Run("upstream disconnects", func(t *testing.T) {
+		c, err := net.Dial("tcp", s.Addr)
+		require.NoError(t, err)
+		defer c.Close()
+		_, err = c.Write([]byte("not a valid name!\n"))
+		require.NoError(t, err)
+
+		// The chat server hangs up, and the proxy hangs up on us in turn
+		got, err := io.ReadAll(c)
+		require.NoError(t, err)
+		assert.Equal(t, "Welcome to budgetchat! What shall I call you?\nUsername must consist entirely of alphanumeric characters\n", string(got))
+		c.Close()
+		st := <-stats
+		assert.Equal(t, int64(1), st.LinesUp)
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		bob, err := New(upstream.Addr)
+		require.NoError(t, err)
+		defer bob.Close()
+		assert.Equal(t, "Welcome to budgetchat! What shall I call you?", bob.ReadMessage())
+		require.NoError(t, bob.SendMessage("bob"))
+		bob.ReadMessage()
+
+		alice, err := New(s.Addr)
+		require.NoError(t, err)
+		assert.Equal(t, "Welcome to budgetchat! What shall I call you?", alice.ReadMessage())
+		require.NoError(t, alice.SendMessage("alice"))
+		assert.Equal(t, "* The room contains: bob", alice.ReadMessage())
+		assert.Equal(t, "* alice has entered the room", bob.ReadMessage())
+
+		require.NoError(t, alice.SendMessage("pay 7F1u3wSD5RbOHQmupo9nx4TnhQ"))
+		assert.Equal(t, "[alice] pay "+mobinthemiddle.TonyAddress, bob.ReadMessage())
+		require.NoError(t, bob.SendMessage("no, pay 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX"))
+		assert.Equal(t, "[bob] no, pay "+mobinthemiddle.TonyAddress, alice.ReadMessage())
+		alice.Close()
+
+		st := <-stats
+		assert.Equal(t, int64(2), st.LinesUp)
+		assert.Equal(t, int64(3), st.LinesDown)
+		assert.Equal(t, int64(len("alice\npay "+mobinthemiddle.TonyAddress+"\n")), st.BytesUp)
+		assert.Equal(t, int64(1), st.RewrittenUp)
+		assert.Equal(t, int64(1), st.RewrittenDown)
+	})
+}
@@ -1,13 +1,19 @@
 package tests
 
 import (
+	"bufio"
 	"context"
 	"io"
+	"math/rand"
 	"net"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	linereversal "github.com/fanatic/protohackers/7_linereversal"
+	"github.com/fanatic/protohackers/lrcp"
+	"github.com/fanatic/protohackers/lrcp/lrcptest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -245,6 +251,23 @@ func TestLevel7LineReversal(t *testing.T) {
 		expect(t, conn, "/ack/1/21/")
 	})
 
+	t.Run("lrcp client", func(t *testing.T) {
+		conn, err := lrcp.Dial(s.Addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+
+		for _, line := range []string{"hello", "foo/bar\\baz", strings.Repeat("PROTOHACKERS ", 200)} {
+			_, err := conn.Write([]byte(line + "\n"))
+			require.NoError(t, err)
+
+			reversed, err := r.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, linereversal.Reverse(line)+"\n", reversed)
+		}
+	})
+
 	t.Run("long lines with 25% loss", func(t *testing.T) {
 		// NOTE:check starts
 		// NOTE:checking whether long lines work (with 25% packet loss)
@@ -318,3 +341,90 @@ func expect(t *testing.T, conn net.Conn, msg string) {
 	require.NoError(t, err)
 	assert.Equal(t, msg, string(received[:n])) // will be truncated to expected message length
 }
+
+func TestLevel7LineReversalLossyNetwork(t *testing.T) {
+	scenarios := []struct {
+		name string
+		cfg  lrcptest.Config
+		opts []lrcp.Option
+	}{
+		{"25% loss", lrcptest.Config{Loss: 0.25}, nil},
+		{"loss, duplication and reordering", lrcptest.Config{Loss: 0.25, Duplicate: 0.1, Reorder: 0.2, Delay: 20 * time.Millisecond}, nil},
+		{"windows smaller than a line", lrcptest.Config{Loss: 0.1}, []lrcp.Option{lrcp.WithReceiveWindow(500), lrcp.WithSendWindow(500)}},
+	}
+	for _, sc := range scenarios {
+		sc := sc
+		t.Run(sc.name, func(t *testing.T) {
+			var server *lrcptest.LossyConn
+			s, err := linereversal.NewServer(context.Background(), "127.0.0.1:0", linereversal.WithConnWrapper(func(conn net.PacketConn) net.PacketConn {
+				cfg := sc.cfg
+				cfg.Seed = 1
+				server = lrcptest.Wrap(conn, cfg)
+				return server
+			}), linereversal.WithLRCPOptions(sc.opts...))
+			require.NoError(t, err)
+			defer s.Close()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 3; i++ {
+				i := i
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					cfg := sc.cfg
+					cfg.Seed = int64(i + 2)
+					reverseLines(t, s.Addr, cfg, rand.New(rand.NewSource(cfg.Seed)), sc.opts...)
+				}()
+			}
+			wg.Wait()
+
+			stats := server.Stats()
+			assert.NotZero(t, stats.Dropped)
+			t.Logf("server datagrams: %+v", stats)
+		})
+	}
+}
+
+// reverseLines sends random lines over a lossy client and checks that
+// every one comes back reversed, in order
+func reverseLines(t *testing.T, addr string, cfg lrcptest.Config, rng *rand.Rand, opts ...lrcp.Option) {
+	conn, err := lrcptest.Listen(cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	c, err := lrcp.DialPacket(conn, addr, opts...)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(60 * time.Second))
+
+	words := []string{"hello", "PROTOHACKERS", "casino", "a/b", "c\\d", "//", "\\\\", "jackdaws", "sphinx", "of", "quartz"}
+	lines := make([]string, 10)
+	for i := range lines {
+		var b strings.Builder
+		for n := rng.Intn(200); n > 0; n-- {
+			b.WriteString(words[rng.Intn(len(words))])
+			b.WriteByte(' ')
+		}
+		lines[i] = b.String()
+	}
+	lines[len(lines)/2] = "" // reversed, a one byte write
+
+	go func() {
+		for _, line := range lines {
+			if _, err := c.Write([]byte(line + "\n")); err != nil {
+				return
+			}
+		}
+	}()
+
+	r := bufio.NewReader(c)
+	for i, line := range lines {
+		got, err := r.ReadString('\n')
+		if !assert.NoError(t, err, "line %d", i) {
+			return
+		}
+		assert.Equal(t, linereversal.Reverse(line)+"\n", got, "line %d", i)
+	}
+}